@@ -0,0 +1,24 @@
+// Generates a CURVE keypair for securing the ZMQ ingestion sockets of TAS.
+// The server uses the secret key of its keypair (ZMQCurveSecretKey) and
+// lists the public keys of the allowed clients (ZMQCurveClientKeys);
+// clients need the server's public key and a keypair of their own.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func main() {
+	public, secret, err := tas.NewCurveKeypair()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to generate keypair:", err)
+		os.Exit(1)
+	}
+	fmt.Println("public:", public)
+	fmt.Println("secret:", secret)
+}
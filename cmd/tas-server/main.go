@@ -0,0 +1,35 @@
+// Runs a TAS server configured from a JSON file, TAS_* environment
+// variables and command line flags, in increasing order of precedence.
+// Run with -help for the list of settings. SIGHUP reloads the configuration.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func main() {
+	config, err := tas.LoadTASConfig(os.Args[0], os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	// SIGHUP and /RELOAD read the file and the environment again
+	config.ReloadConfig = func() (*tas.TASConfig, error) {
+		return tas.LoadTASConfig(os.Args[0], os.Args[1:], os.Environ())
+	}
+	svr, err := tas.NewTASServer(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start TAS:", err)
+		os.Exit(1)
+	}
+	svr.Run()
+}
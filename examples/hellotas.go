@@ -3,7 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	zmq "github.com/pebbe/zmq3"
+	zmq "github.com/pebbe/zmq4"
 	"io/ioutil"
 	"net/http"
 	"strconv"
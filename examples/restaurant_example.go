@@ -17,7 +17,7 @@ package main
 
 import (
 	"fmt"
-	zmq "github.com/pebbe/zmq3"
+	zmq "github.com/pebbe/zmq4"
 	"log"
 	"math/rand"
 	"strconv"
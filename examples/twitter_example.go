@@ -10,7 +10,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	zmq "github.com/pebbe/zmq3"
+	zmq "github.com/pebbe/zmq4"
 	"log"
 	"math/rand"
 	"strconv"
@@ -0,0 +1,214 @@
+package tas
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Path of the versioned JSON API, under HTTPPrefix
+const apiPath = "/api/v1/"
+
+// Error returned by the JSON API as {"error": {...}}
+type apiError struct {
+	Status  int    `json:"status"`  // HTTP status code
+	Code    string `json:"code"`    // Machine readable kind of error, ie/ "bad_parameter"
+	Message string `json:"message"` // Description for humans
+	allow   string // Methods allowed, for 405 responses
+}
+
+func newAPIError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func methodNotAllowed(methods string) *apiError {
+	e := newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed, use %s", methods)
+	e.allow = methods
+	return e
+}
+
+// Writes an error as plain text, as the legacy endpoints do
+func writePlainError(w http.ResponseWriter, e *apiError) {
+	if e.allow != "" {
+		w.Header().Set("Allow", e.allow)
+	}
+	http.Error(w, e.Message, e.Status)
+}
+
+// Writes an error in the envelope of the JSON API
+func writeAPIError(w http.ResponseWriter, e *apiError) {
+	if e.allow != "" {
+		w.Header().Set("Allow", e.allow)
+	}
+	writeAPI(w, e.Status, map[string]interface{}{"error": e})
+}
+
+// Writes data in the envelope of the JSON API, as {"data": ...}
+func writeAPIData(w http.ResponseWriter, data interface{}) {
+	writeAPI(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+func writeAPI(w http.ResponseWriter, status int, body interface{}) {
+	returnVal, err := json.Marshal(body)
+	if err != nil {
+		status = http.StatusInternalServerError
+		returnVal, _ = json.Marshal(map[string]interface{}{
+			"error": newAPIError(status, "internal", "Could not encode the response: %v", err),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(returnVal)
+}
+
+// Like authorize, answering refused requests in the envelope of the API
+func (t *TASServer) authorizeAPI(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return t.authorizeWith(scope, handler, func(w http.ResponseWriter, code int, message string) {
+		kind := "unauthorized"
+		if code == http.StatusForbidden {
+			kind = "forbidden"
+		}
+		writeAPIError(w, newAPIError(code, kind, "%s", message))
+	})
+}
+
+// Adds the endpoints of the JSON API to mux
+func (t *TASServer) registerAPI(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+apiPath+"values", t.authorizeAPI(ScopeRead, t.apiValues))
+	mux.HandleFunc(prefix+apiPath+"diag", t.authorizeAPI(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		if !allowRead(w, r) {
+			return
+		}
+		writeAPIData(w, t.diagnostics())
+	}))
+	mux.HandleFunc(prefix+apiPath+"deadletter", t.authorizeAPI(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		if !allowRead(w, r) {
+			return
+		}
+		writeAPIData(w, t.deadLetterReport())
+	}))
+	mux.HandleFunc(prefix+apiPath+"ingest", t.authorizeAPI(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		response, apiErr := t.ingestRequest(w, r)
+		if apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		writeAPIData(w, response)
+	}))
+	mux.HandleFunc(prefix+apiPath+"reload", t.authorizeAPI(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		result, apiErr := t.reloadRequest(r)
+		if apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		writeAPIData(w, result)
+	}))
+	mux.HandleFunc(prefix+apiPath, t.authorizeAPI(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, newAPIError(http.StatusNotFound, "not_found", "No API endpoint %s", r.URL.Path))
+	}))
+}
+
+// Refuses requests that are not a GET or HEAD with a 405
+func allowRead(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeAPIError(w, methodNotAllowed("GET, HEAD"))
+		return false
+	}
+	return true
+}
+
+// Parameters of a value query
+type valueQuery struct {
+	key             []string
+	tsList          []string // Buckets to read, all of them if empty
+	intervalSeconds float64
+	format          string // formatJSON, formatCSV or formatNDJSON
+	buckets         bool   // A row for each bucket rather than for each key
+}
+
+// Returns the value query of a request: the key, the buckets in t (comma
+// separated timestamps) and the interval in i (5 seconds by default)
+func (t *TASServer) parseValueQuery(r *http.Request) (q valueQuery, apiErr *apiError) {
+	key := r.FormValue("key")
+	if key == "" {
+		return q, newAPIError(http.StatusBadRequest, "bad_parameter", "key is required")
+	}
+	q.key = strings.Split(key, ".")
+	for _, segment := range q.key {
+		if segment == "" {
+			return q, newAPIError(http.StatusBadRequest, "bad_parameter", "key %q has an empty segment", key)
+		}
+	}
+
+	if r.FormValue("t") != "" {
+		for _, ts := range strings.Split(r.FormValue("t"), ",") {
+			if _, err := parseTimestamp(ts); err != nil {
+				return q, newAPIError(http.StatusBadRequest, "bad_parameter", "t %q is not a Unix time", ts)
+			}
+			q.tsList = append(q.tsList, t.bucketKey(ts))
+		}
+	}
+
+	q.intervalSeconds = 5.0
+	if r.FormValue("i") != "" {
+		i, err := strconv.ParseFloat(r.FormValue("i"), 64)
+		if err != nil || !(i > 0) || math.IsInf(i, 0) {
+			return q, newAPIError(http.StatusBadRequest, "bad_parameter", "i %q is not a positive number of seconds", r.FormValue("i"))
+		}
+		q.intervalSeconds = i
+	}
+	return q, nil
+}
+
+// Returns whether a value from the tree holds no data
+func isEmptyValue(v interface{}) bool {
+	if m, ok := v.(map[string]interface{}); ok {
+		return len(m) == 0
+	}
+	return v == nil
+}
+
+// API endpoint with the value of a key, or the values of the keys matched
+// by a key with wildcards. With buckets=true or in the CSV and NDJSON
+// formats the values are flattened to rows.
+func (t *TASServer) apiValues(w http.ResponseWriter, r *http.Request) {
+	if !allowRead(w, r) {
+		return
+	}
+	q, apiErr := t.parseValueQuery(r)
+	if apiErr == nil {
+		q.format, apiErr = queryFormat(r, true)
+	}
+	if apiErr == nil {
+		q.buckets, apiErr = queryBuckets(r)
+	}
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	notFound := newAPIError(http.StatusNotFound, "not_found", "No data for key %q", r.FormValue("key"))
+
+	if q.format == formatJSON && !q.buckets {
+		val := t.pfdTree.GetValue(q.key, q.tsList, q.intervalSeconds)
+		if isEmptyValue(val) {
+			writeAPIError(w, notFound)
+			return
+		}
+		writeAPIData(w, val)
+		return
+	}
+
+	rows := t.pfdTree.GetRows(q.key, q.tsList, q.intervalSeconds, q.buckets)
+	if len(rows) == 0 {
+		writeAPIError(w, notFound)
+		return
+	}
+	if q.format == formatJSON {
+		writeAPIData(w, newJSONRows(rows))
+		return
+	}
+	writeRows(w, q.format, rows)
+}
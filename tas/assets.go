@@ -0,0 +1,59 @@
+package tas
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+)
+
+// Templates of the HTML pages, and the scripts and style sheets they load
+// from static/
+//
+//go:embed html
+var embeddedAssets embed.FS
+
+// Templates of the HTML pages
+var pageTemplates = []string{"main.html", "tree-d3.html", "ts-stats-d3.html"}
+
+// File system with the files of dir, and the files of base that dir does
+// not have
+type overlayFS struct {
+	dir  fs.FS
+	base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return o.base.Open(name)
+}
+
+// Returns the assets of the HTTP pages: the embedded ones, overridden by
+// the files in dir if it is not empty
+func loadAssets(dir string) (fs.FS, error) {
+	assets, err := fs.Sub(embeddedAssets, "html")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return assets, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return overlayFS{dir: os.DirFS(dir), base: assets}, nil
+}
+
+// Parses the templates of the HTML pages, once for all requests
+func parsePages(assets fs.FS) (*template.Template, error) {
+	return template.ParseFS(assets, pageTemplates...)
+}
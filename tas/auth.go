@@ -0,0 +1,114 @@
+package tas
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scopes of HTTP credentials. Admin credentials can also read.
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+// Credentials accepted by the HTTP server, either a bearer token or a user
+// name and password for basic auth
+type HTTPCredential struct {
+	Token    string // Bearer token
+	User     string // User name for basic auth
+	Password string // Password for basic auth
+	Scope    string // ScopeRead or ScopeAdmin
+}
+
+// Checks that every credential is usable
+func checkCredentials(credentials []HTTPCredential) error {
+	for i, c := range credentials {
+		if c.Scope != ScopeRead && c.Scope != ScopeAdmin {
+			return fmt.Errorf("credential %d has scope %q, expected %q or %q", i+1, c.Scope, ScopeRead, ScopeAdmin)
+		}
+		if c.Token == "" && (c.User == "" || c.Password == "") {
+			return fmt.Errorf("credential %d needs a token, or a user and password", i+1)
+		}
+	}
+	return nil
+}
+
+// Returns the TLS configuration serving the certificate in certFile with
+// the key in keyFile, or nil for plain HTTP when neither is set
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("HTTPS needs both HTTPTLSCertFile and HTTPTLSKeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load the HTTPS certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Returns the scope granted to the credentials of a request, or "" when it
+// has none or they are not valid
+func findScope(credentials []HTTPCredential, r *http.Request) string {
+	user, password, basic := r.BasicAuth()
+	token := ""
+	// The scheme is case-insensitive (RFC 7235)
+	if auth := r.Header.Get("Authorization"); len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+
+	scope := ""
+	for _, c := range credentials {
+		var ok bool
+		if c.Token != "" {
+			ok = token != "" && secureEqual(c.Token, token)
+		} else {
+			ok = basic && secureEqual(c.User, user) && secureEqual(c.Password, password)
+		}
+		if ok && (scope == "" || c.Scope == ScopeAdmin) {
+			scope = c.Scope
+		}
+	}
+	return scope
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Wraps a handler so that it is only served to requests with credentials
+// for scope. Every request is served when no credentials are configured.
+func (t *TASServer) authorize(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return t.authorizeWith(scope, handler, func(w http.ResponseWriter, code int, message string) {
+		http.Error(w, message, code)
+	})
+}
+
+// Like authorize, with deny writing the response to refused requests
+func (t *TASServer) authorizeWith(scope string, handler http.HandlerFunc, deny func(w http.ResponseWriter, code int, message string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credentials := t.conf().HTTPCredentials
+		if len(credentials) == 0 {
+			handler(w, r)
+			return
+		}
+
+		granted := findScope(credentials, r)
+		if granted == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="TAS"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="TAS"`)
+			deny(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if scope == ScopeAdmin && granted != ScopeAdmin {
+			deny(w, http.StatusForbidden, "Forbidden, admin scope required")
+			return
+		}
+		handler(w, r)
+	}
+}
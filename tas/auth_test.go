@@ -0,0 +1,195 @@
+package tas
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	// Requests are served according to the scope of their credentials, and
+	// refused without valid ones
+
+	s := &TASServer{config: &TASConfig{HTTPCredentials: []HTTPCredential{
+		{Token: "read-token", Scope: ScopeRead},
+		{Token: "admin-token", Scope: ScopeAdmin},
+		{User: "reader", Password: "read-pass", Scope: ScopeRead},
+		{User: "producer", Password: "admin-pass", Scope: ScopeAdmin},
+	}}}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	handlers := map[string]http.HandlerFunc{
+		ScopeRead:  s.authorize(ScopeRead, ok),
+		ScopeAdmin: s.authorize(ScopeAdmin, ok),
+	}
+
+	for _, test := range []struct {
+		name  string
+		auth  func(r *http.Request)
+		read  int
+		admin int
+	}{
+		{"no header", func(r *http.Request) {}, 401, 401},
+		{"read token", authHeader("Bearer read-token"), 200, 403},
+		{"admin token", authHeader("Bearer admin-token"), 200, 200},
+		{"lower case scheme", authHeader("bearer admin-token"), 200, 200},
+		{"upper case scheme", authHeader("BEARER read-token"), 200, 403},
+		{"wrong token", authHeader("Bearer nope"), 401, 401},
+		{"empty token", authHeader("Bearer "), 401, 401},
+		{"token without scheme", authHeader("admin-token"), 401, 401},
+		{"basic reader", basic("reader", "read-pass"), 200, 403},
+		{"basic producer", basic("producer", "admin-pass"), 200, 200},
+		{"basic wrong user", basic("nobody", "admin-pass"), 401, 401},
+		{"basic wrong password", basic("producer", "read-pass"), 401, 401},
+		{"basic password of another user", basic("reader", "admin-pass"), 401, 401},
+		{"garbled basic", authHeader("Basic !!not base64!!"), 401, 401},
+		{"basic without colon", authHeader("Basic cHJvZHVjZXI="), 401, 401},
+		{"unknown scheme", authHeader("Digest username=producer"), 401, 401},
+	} {
+		for scope, expected := range map[string]int{ScopeRead: test.read, ScopeAdmin: test.admin} {
+			r := httptest.NewRequest("GET", "/", nil)
+			test.auth(r)
+			w := httptest.NewRecorder()
+			handlers[scope](w, r)
+			if w.Code != expected {
+				t.Errorf("%s got %d instead of %d for scope %s", test.name, w.Code, expected, scope)
+			}
+			if w.Code == 401 && len(w.Header()["Www-Authenticate"]) != 2 {
+				t.Errorf("%s got 401 without the challenges: %v", test.name, w.Header())
+			}
+		}
+	}
+}
+
+func authHeader(header string) func(r *http.Request) {
+	// Sets the Authorization header as given
+
+	return func(r *http.Request) { r.Header.Set("Authorization", header) }
+}
+
+func basic(user, password string) func(r *http.Request) {
+	// Sets basic auth credentials
+
+	return func(r *http.Request) { r.SetBasicAuth(user, password) }
+}
+
+func TestAuthorizeWithoutCredentials(t *testing.T) {
+	// Every request is served when no credentials are configured
+
+	s := &TASServer{config: &TASConfig{}}
+	w := httptest.NewRecorder()
+	s.authorize(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {})(w, httptest.NewRequest("POST", "/INGEST", nil))
+	if w.Code != 200 {
+		t.Errorf("Got %d without credentials configured", w.Code)
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	// Credentials need a known scope and a token or a user and password
+
+	for _, test := range []struct {
+		credential HTTPCredential
+		valid      bool
+	}{
+		{HTTPCredential{Token: "t", Scope: ScopeRead}, true},
+		{HTTPCredential{User: "u", Password: "p", Scope: ScopeAdmin}, true},
+		{HTTPCredential{Token: "t", Scope: "write"}, false},
+		{HTTPCredential{Token: "t"}, false},
+		{HTTPCredential{User: "u", Scope: ScopeRead}, false},
+		{HTTPCredential{Password: "p", Scope: ScopeRead}, false},
+	} {
+		if err := checkCredentials([]HTTPCredential{test.credential}); (err == nil) != test.valid {
+			t.Errorf("%+v valid is %v: %v", test.credential, err == nil, err)
+		}
+	}
+}
+
+func writeCertificate(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	// Generates a self-signed certificate for localhost and returns the
+	// paths of its PEM files and a pool that trusts it
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, pool
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	// The certificate files configure HTTPS, which clients trusting the
+	// certificate can use
+
+	certFile, keyFile, pool := writeCertificate(t)
+	config, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || resp.StatusCode != 200 {
+		t.Errorf("Got %d over TLS %v", resp.StatusCode, resp.TLS != nil)
+	}
+
+	if config, err = loadTLSConfig("", ""); config != nil || err != nil {
+		t.Errorf("No certificate gave %v: %v", config, err)
+	}
+	for _, files := range [][2]string{{certFile, ""}, {"", keyFile}, {keyFile, certFile}, {certFile + ".missing", keyFile}} {
+		if _, err = loadTLSConfig(files[0], files[1]); err == nil {
+			t.Errorf("Loaded a certificate from %q and %q", files[0], files[1])
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package tas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+import (
+	"github.com/chango/tas/tree"
+)
+
+// Frames in the binary protocol start with BinaryMagic followed by a
+// version byte, then one or more records until the end of the frame:
+//
+//	verb      1 byte (BinaryINCR, BinaryAPPEND or BinaryGAUGE), with
+//	          BinaryServerTime set for records that take the server time
+//	timestamp signed varint, Unix nanoseconds (left out with
+//	          BinaryServerTime)
+//	key       uvarint length followed by the key
+//	value     INCR: signed varint
+//	          APPEND: uvarint element count followed by the elements,
+//	          each a type byte and its encoding (see the Binary* types)
+//	          GAUGE: IEEE 754 float64, big endian
+//
+// The magic starts with a zero byte, which never starts a text message.
+var BinaryMagic = []byte{0x00, 'T', 'A', 'S'}
+
+// Version of the binary protocol written by EncodeBinary
+const BinaryVersion = 1
+
+// Verbs in the binary protocol
+const (
+	BinaryINCR   = 1
+	BinaryAPPEND = 2
+	BinaryGAUGE  = 3
+)
+
+// Flag of the verb byte for records without a timestamp, which are stamped
+// with the server time
+const BinaryServerTime = 0x80
+
+// Types of APPEND elements in the binary protocol
+const (
+	BinaryInt    = 1 // signed varint
+	BinaryFloat  = 2 // IEEE 754 float64, big endian
+	BinaryString = 3 // uvarint length followed by the string
+	BinaryTrue   = 4
+	BinaryFalse  = 5
+	BinaryNull   = 6
+	BinaryJSON   = 7 // uvarint length followed by any JSON value
+)
+
+var errShortFrame = errors.New("binary frame is truncated")
+
+// A single command of the ingestion protocol
+type Message struct {
+	Verb      string      // INCR, APPEND or GAUGE
+	Timestamp string      // As accepted in the text protocol, e.g. "1404148628" or "now"
+	UnixNano  int64       // Timestamp in Unix nanoseconds, used when Timestamp is empty
+	Key       string      // Dotted key
+	Value     interface{} // int for INCR, []interface{} for APPEND, float64 or tree.GaugeDelta for GAUGE
+}
+
+// Returns the message in the text protocol
+func (m Message) String() string {
+	value, err := json.Marshal(m.Value)
+	if err != nil {
+		value = []byte(fmt.Sprintf("%v", m.Value))
+	}
+	timestamp := m.Timestamp
+	if timestamp == "" {
+		timestamp = tree.FormatTimestamp(m.UnixNano)
+	}
+	return fmt.Sprintf("%s %s %s %s", m.Verb, timestamp, m.Key, value)
+}
+
+// Reports whether frame is encoded in the binary protocol
+func IsBinary(frame []byte) bool {
+	return bytes.HasPrefix(frame, BinaryMagic)
+}
+
+// Decodes a binary frame into its messages. When the frame is invalid the
+// messages decoded before the error are returned along with the error.
+func DecodeBinary(frame []byte) ([]Message, error) {
+	if !IsBinary(frame) {
+		return nil, errors.New("binary frame has no magic prefix")
+	}
+	d := &binaryDecoder{buf: frame[len(BinaryMagic):]}
+	version, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	if version != BinaryVersion {
+		return nil, fmt.Errorf("unsupported binary protocol version %d", version)
+	}
+
+	var messages []Message
+	for len(d.buf) > 0 {
+		m, err := d.message()
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// Encodes messages as a single binary frame
+func EncodeBinary(messages []Message) ([]byte, error) {
+	buf := append([]byte{}, BinaryMagic...)
+	buf = append(buf, BinaryVersion)
+	for _, m := range messages {
+		var err error
+		if buf, err = appendMessage(buf, m); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendMessage(buf []byte, m Message) ([]byte, error) {
+	var flags byte
+	ts := m.UnixNano
+	switch m.Timestamp {
+	case "":
+	case TimestampNow, TimestampDash:
+		flags = BinaryServerTime
+	default:
+		var err error
+		if ts, err = parseTimestamp(m.Timestamp); err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %v", m.Timestamp, err)
+		}
+	}
+
+	switch m.Verb {
+	case "INCR":
+		value, ok := m.Value.(int)
+		if !ok {
+			return nil, fmt.Errorf("INCR value %v is not an int", m.Value)
+		}
+		buf = appendHeader(buf, BinaryINCR|flags, ts)
+		buf = appendString(buf, m.Key)
+		return binary.AppendVarint(buf, int64(value)), nil
+	case "APPEND":
+		values, ok := m.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("APPEND value %v is not a slice", m.Value)
+		}
+		buf = appendHeader(buf, BinaryAPPEND|flags, ts)
+		buf = appendString(buf, m.Key)
+		buf = binary.AppendUvarint(buf, uint64(len(values)))
+		for _, v := range values {
+			var err error
+			if buf, err = appendElement(buf, v); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case "GAUGE":
+		value, ok := m.Value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("GAUGE value %v is not a float64", m.Value)
+		}
+		buf = appendHeader(buf, BinaryGAUGE|flags, ts)
+		buf = appendString(buf, m.Key)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(value)), nil
+	}
+	return nil, fmt.Errorf("unknown verb %q", m.Verb)
+}
+
+// Appends the verb byte and, unless the record takes the server time, the
+// timestamp
+func appendHeader(buf []byte, verb byte, ts int64) []byte {
+	buf = append(buf, verb)
+	if verb&BinaryServerTime != 0 {
+		return buf
+	}
+	return binary.AppendVarint(buf, ts)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendElement(buf []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(buf, BinaryNull), nil
+	case bool:
+		if x {
+			return append(buf, BinaryTrue), nil
+		}
+		return append(buf, BinaryFalse), nil
+	case int:
+		return binary.AppendVarint(append(buf, BinaryInt), int64(x)), nil
+	case int64:
+		return binary.AppendVarint(append(buf, BinaryInt), x), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, BinaryFloat), math.Float64bits(x)), nil
+	case string:
+		return appendString(append(buf, BinaryString), x), nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendString(append(buf, BinaryJSON), string(raw)), nil
+}
+
+type binaryDecoder struct {
+	buf []byte
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	if len(d.buf) == 0 {
+		return 0, errShortFrame
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		return 0, errShortFrame
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errShortFrame
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// Decodes a float64, which must be a valid JSON number
+func (d *binaryDecoder) float() (float64, error) {
+	if len(d.buf) < 8 {
+		return 0, errShortFrame
+	}
+	v := math.Float64frombits(binary.BigEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("float %v is not a JSON number", v)
+	}
+	return v, nil
+}
+
+func (d *binaryDecoder) string() (string, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(len(d.buf)) {
+		return "", errShortFrame
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s, nil
+}
+
+func (d *binaryDecoder) message() (m Message, err error) {
+	verb, err := d.byte()
+	if err != nil {
+		return
+	}
+	if verb&BinaryServerTime != 0 {
+		m.Timestamp = TimestampNow
+	} else if m.UnixNano, err = d.varint(); err != nil {
+		return
+	}
+	if m.Key, err = d.string(); err != nil {
+		return
+	}
+
+	switch verb &^ BinaryServerTime {
+	case BinaryINCR:
+		m.Verb = "INCR"
+		var v int64
+		if v, err = d.varint(); err != nil {
+			return
+		}
+		if int64(int(v)) != v {
+			err = fmt.Errorf("INCR value %d is out of range", v)
+			return
+		}
+		m.Value = int(v)
+	case BinaryAPPEND:
+		m.Verb = "APPEND"
+		var n uint64
+		if n, err = d.uvarint(); err != nil {
+			return
+		}
+		// Every element takes at least one byte
+		if n > uint64(len(d.buf)) {
+			err = errShortFrame
+			return
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = d.element(); err != nil {
+				return
+			}
+		}
+		m.Value = values
+	case BinaryGAUGE:
+		m.Verb = "GAUGE"
+		m.Value, err = d.float()
+	default:
+		err = fmt.Errorf("unknown binary verb %d", verb)
+	}
+	return
+}
+
+// Decodes an APPEND element into the same types encoding/json produces
+// for the text protocol
+func (d *binaryDecoder) element() (interface{}, error) {
+	kind, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case BinaryInt:
+		v, err := d.varint()
+		return float64(v), err
+	case BinaryFloat:
+		return d.float()
+	case BinaryString:
+		return d.string()
+	case BinaryTrue:
+		return true, nil
+	case BinaryFalse:
+		return false, nil
+	case BinaryNull:
+		return nil, nil
+	case BinaryJSON:
+		raw, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			return nil, fmt.Errorf("invalid JSON element: %v", err)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown binary element type %d", kind)
+}
+
+// Returns a printable form of a binary frame that could not be decoded
+func quoteFrame(frame []byte) string {
+	const maxLen = 256
+	if len(frame) > maxLen {
+		return strconv.Quote(string(frame[:maxLen])) + "..."
+	}
+	return strconv.Quote(string(frame))
+}
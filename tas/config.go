@@ -1,19 +1,245 @@
 package tas
 
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
 type TASConfig struct {
-	ZMQPort     string // Port to listen for ZMQ traffic (from agents)
+	ZMQPort     string // Port to listen for ZMQ traffic (from agents, empty to disable)
 	ZMQAddress  string // Address to listen for ZMQ traffic (from agents)
-	HTTPPort    string // HTTP Port to listen on for querying/stats
+	ZMQAckPort  string // Port to listen for acknowledged ZMQ REQ traffic (empty to disable)
+	HTTPPort    string // HTTP Port to listen on for querying/stats (empty to only serve through Handler)
 	HTTPAddress string // HTTP Address to listen on for querying/stats
+	HTTPPrefix  string // Path prefix of the HTTP pages, ie/ "/tas"
+
+	HTTPAssetsDir string // Directory with templates and static files that replace the embedded ones (empty for none)
+
+	HTTPTLSCertFile string           // PEM certificate file, enables HTTPS together with HTTPTLSKeyFile
+	HTTPTLSKeyFile  string           // PEM private key file of the certificate
+	HTTPCredentials []HTTPCredential // Credentials accepted by the HTTP server (no authentication if empty)
+
+	ZMQCurveSecretKey  string   // Z85 encoded server secret key, enables CURVE security on the ZMQ sockets
+	ZMQCurveClientKeys []string // Z85 encoded public keys of the clients allowed to connect (any if empty)
+
+	TCPPort           string        // Port to listen for newline separated messages over TCP (empty to disable)
+	TCPAddress        string        // Address to listen for newline separated messages over TCP
+	TCPMaxLineBytes   int           // Longest line accepted over TCP
+	TCPIdleTimeout    time.Duration // TCP connections without traffic for this long are closed (0 to disable)
+	TCPMaxConnections int           // Number of concurrent TCP connections allowed (0 for no limit)
+	TCPAck            bool          // Reply to every TCP line with "OK 1" or "ERR" and a JSON object
+
+	Transports []Transport // Additional transports to receive messages from
+
+	DeadLetterSize     int   // Number of rejected messages kept for /DEADLETTER
+	HTTPIngestMaxBytes int64 // Largest request body accepted by /INGEST
+
+	MaxPastSkew   time.Duration // How far in the past a timestamp may be (0 to disable)
+	MaxFutureSkew time.Duration // How far in the future a timestamp may be (0 to disable)
+	SkewPolicy    string        // SkewReject or SkewClamp timestamps outside the window
+
+	BucketWidth time.Duration // Width of the time buckets data is grouped in
+
+	Retention  time.Duration // How long data is kept before the GC deletes it
+	GCInterval time.Duration // How often the GC runs
+
+	StatsDPort    string // UDP port to listen for StatsD traffic on (empty to disable)
+	StatsDAddress string // UDP address to listen for StatsD traffic on
+	StatsDPrefix  string // Prefix added to the keys of StatsD metrics
+
+	GraphitePort        string         // TCP and UDP port to listen for Graphite traffic on (empty to disable)
+	GraphiteAddress     string         // TCP and UDP address to listen for Graphite traffic on
+	GraphiteDefaultMode string         // GraphiteSum or GraphiteGauge for paths without a rule
+	GraphiteRules       []GraphiteRule // Value semantics per path prefix
+
+	GraphiteMaxLineBytes   int           // Longest line accepted over TCP, longer lines close the connection
+	GraphiteIdleTimeout    time.Duration // TCP connections without traffic for this long are closed (0 to disable)
+	GraphiteMaxConnections int           // Number of concurrent TCP connections allowed (0 for no limit)
+
+	ExportRules []ExportRule // Keys exported by /EXPORT as OpenMetrics series
+
+	MemoryBudget int64 // Heap bytes in use above which /readyz reports not ready (0 for no budget)
+
+	Logger              *slog.Logger // Logger of the server, built from the settings below if nil
+	LogLevel            string       // LogDebug, LogInfo, LogWarn or LogError
+	LogFormat           string       // LogLogfmt or LogJSON
+	LogOutput           string       // "stderr", "stdout" or the path of a file to append to
+	LogSampleFirst      int          // Records about individual messages logged every second before sampling
+	LogSampleThereafter int          // Log one in this many of the further records about individual messages (0 for none)
+
+	ReloadConfig func() (*TASConfig, error) // Returns the configuration to apply on SIGHUP and /RELOAD (reloading disabled if nil)
 }
 
-// Returns a default TAS server configuration that uses the default ports
+// Returns a default TAS server configuration that uses the default ports.
+// Builds without ZMQ leave ZMQPort empty.
 func NewDefaultTASConfig() (c *TASConfig) {
 	c = &TASConfig{
-		ZMQPort:     "7450",
+		ZMQPort:     defaultZMQPort,
 		ZMQAddress:  "*",
 		HTTPPort:    "7451",
 		HTTPAddress: "0.0.0.0",
+
+		TCPAddress:      "0.0.0.0",
+		TCPMaxLineBytes: 1 << 20,
+		TCPIdleTimeout:  5 * time.Minute,
+
+		DeadLetterSize:     100,
+		HTTPIngestMaxBytes: 16 << 20,
+		SkewPolicy:         SkewReject,
+		BucketWidth:        time.Second,
+
+		Retention:  60 * time.Second,
+		GCInterval: 4 * time.Second,
+
+		StatsDAddress: "0.0.0.0",
+
+		GraphiteAddress:     "0.0.0.0",
+		GraphiteDefaultMode: GraphiteGauge,
+
+		GraphiteMaxLineBytes: 1 << 16,
+		GraphiteIdleTimeout:  5 * time.Minute,
+
+		LogLevel:            defaultLogLevel(),
+		LogFormat:           LogLogfmt,
+		LogOutput:           "stderr",
+		LogSampleFirst:      10,
+		LogSampleThereafter: 100,
 	}
 	return
 }
+
+// Returns a copy of the configuration where the settings that cannot be
+// zero, and were left at zero (ie/ by programs that build a TASConfig with
+// the settings of earlier versions only), have their default value
+func (c *TASConfig) withDefaults() *TASConfig {
+	d := NewDefaultTASConfig()
+	next := *c
+	if next.TCPMaxLineBytes == 0 {
+		next.TCPMaxLineBytes = d.TCPMaxLineBytes
+	}
+	if next.HTTPIngestMaxBytes == 0 {
+		next.HTTPIngestMaxBytes = d.HTTPIngestMaxBytes
+	}
+	if next.SkewPolicy == "" {
+		next.SkewPolicy = d.SkewPolicy
+	}
+	if next.BucketWidth == 0 {
+		next.BucketWidth = d.BucketWidth
+	}
+	if next.Retention == 0 {
+		next.Retention = d.Retention
+	}
+	if next.GCInterval == 0 {
+		next.GCInterval = d.GCInterval
+	}
+	if next.GraphiteDefaultMode == "" {
+		next.GraphiteDefaultMode = d.GraphiteDefaultMode
+	}
+	return &next
+}
+
+// Error returned by Validate for a setting the server cannot run with
+type SettingError struct {
+	Field  string // Name of the TASConfig field, ie/ "HTTPPort"
+	Reason string
+}
+
+func (e *SettingError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+func settingErrorf(field, format string, a ...interface{}) error {
+	return &SettingError{Field: field, Reason: fmt.Sprintf(format, a...)}
+}
+
+// Checks the configuration for settings the server cannot run with, and
+// returns a *SettingError for the first one. Zero values are accepted
+// where New uses the default instead.
+func (c *TASConfig) Validate() error {
+	ports := []struct {
+		name, port string
+	}{
+		{"ZMQPort", c.ZMQPort},
+		{"ZMQAckPort", c.ZMQAckPort},
+		{"HTTPPort", c.HTTPPort},
+		{"TCPPort", c.TCPPort},
+		{"StatsDPort", c.StatsDPort},
+		{"GraphitePort", c.GraphitePort},
+	}
+	for _, p := range ports {
+		if p.port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(p.port); err != nil || n < 0 || n > 65535 {
+			return settingErrorf(p.name, "%q is not a port number, or empty to disable", p.port)
+		}
+	}
+
+	if c.HTTPTLSCertFile != "" && c.HTTPTLSKeyFile == "" {
+		return settingErrorf("HTTPTLSCertFile", "HTTPS also needs the key file")
+	}
+	if c.HTTPTLSCertFile == "" && c.HTTPTLSKeyFile != "" {
+		return settingErrorf("HTTPTLSKeyFile", "HTTPS also needs the certificate file")
+	}
+	if err := checkCredentials(c.HTTPCredentials); err != nil {
+		return settingErrorf("HTTPCredentials", "%v", err)
+	}
+	if c.ZMQCurveSecretKey != "" {
+		if err := checkCurveKey(c.ZMQCurveSecretKey); err != nil {
+			return settingErrorf("ZMQCurveSecretKey", "%v", err)
+		}
+		for i, key := range c.ZMQCurveClientKeys {
+			if err := checkCurveKey(key); err != nil {
+				return settingErrorf("ZMQCurveClientKeys", "key %d: %v", i+1, err)
+			}
+		}
+	} else if len(c.ZMQCurveClientKeys) > 0 {
+		return settingErrorf("ZMQCurveClientKeys", "client keys need the server secret key")
+	}
+
+	sizes := []struct {
+		name string
+		size int64
+	}{
+		{"TCPMaxLineBytes", int64(c.TCPMaxLineBytes)},
+		{"TCPMaxConnections", int64(c.TCPMaxConnections)},
+		{"DeadLetterSize", int64(c.DeadLetterSize)},
+		{"HTTPIngestMaxBytes", c.HTTPIngestMaxBytes},
+		{"TCPIdleTimeout", int64(c.TCPIdleTimeout)},
+		{"MaxPastSkew", int64(c.MaxPastSkew)},
+		{"MaxFutureSkew", int64(c.MaxFutureSkew)},
+		{"BucketWidth", int64(c.BucketWidth)},
+		{"Retention", int64(c.Retention)},
+		{"GCInterval", int64(c.GCInterval)},
+		{"MemoryBudget", c.MemoryBudget},
+	}
+	for _, s := range sizes {
+		if s.size < 0 {
+			return settingErrorf(s.name, "must not be negative")
+		}
+	}
+	if c.SkewPolicy != "" && c.SkewPolicy != SkewReject && c.SkewPolicy != SkewClamp {
+		return settingErrorf("SkewPolicy", "%q is not %q or %q", c.SkewPolicy, SkewReject, SkewClamp)
+	}
+
+	if err := checkExportRules(c.ExportRules); err != nil {
+		return settingErrorf("ExportRules", "%v", err)
+	}
+	if err := checkLogging(c); err != nil {
+		return err
+	}
+
+	if c.GraphitePort != "" {
+		if mode := c.GraphiteDefaultMode; mode != "" && mode != GraphiteSum && mode != GraphiteGauge {
+			return settingErrorf("GraphiteDefaultMode", "%q is not %q or %q", mode, GraphiteSum, GraphiteGauge)
+		}
+		for _, rule := range c.GraphiteRules {
+			if rule.Mode != GraphiteSum && rule.Mode != GraphiteGauge {
+				return settingErrorf("GraphiteRules", "mode %q of %q is not %q or %q", rule.Mode, rule.Prefix, GraphiteSum, GraphiteGauge)
+			}
+		}
+	}
+	return nil
+}
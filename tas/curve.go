@@ -0,0 +1,82 @@
+package tas
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Alphabet of the Z85 encoding used for CURVE keys
+const z85Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+// Returns a new CURVE keypair, Z85 encoded as ZMQ expects them
+func NewCurveKeypair() (public, secret string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return z85Encode(key.PublicKey().Bytes()), z85Encode(key.Bytes()), nil
+}
+
+// Returns the public key of a Z85 encoded CURVE secret key
+func CurvePublicKey(secret string) (string, error) {
+	raw, err := z85Decode(secret)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", err
+	}
+	return z85Encode(key.PublicKey().Bytes()), nil
+}
+
+// Checks that key is a Z85 encoded CURVE key
+func checkCurveKey(key string) error {
+	raw, err := z85Decode(key)
+	if err != nil {
+		return err
+	}
+	if len(raw) != 32 {
+		return errors.New("CURVE key is not 40 Z85 characters")
+	}
+	return nil
+}
+
+func z85Encode(data []byte) string {
+	var out []byte
+	for i := 0; i+4 <= len(data); i += 4 {
+		value := uint32(data[i])<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3])
+		var chunk [5]byte
+		for j := 4; j >= 0; j-- {
+			chunk[j] = z85Chars[value%85]
+			value /= 85
+		}
+		out = append(out, chunk[:]...)
+	}
+	return string(out)
+}
+
+func z85Decode(s string) ([]byte, error) {
+	if len(s)%5 != 0 {
+		return nil, errors.New("Z85 string length is not a multiple of 5")
+	}
+	var out []byte
+	for i := 0; i < len(s); i += 5 {
+		var value uint64
+		for j := 0; j < 5; j++ {
+			digit := strings.IndexByte(z85Chars, s[i+j])
+			if digit < 0 {
+				return nil, fmt.Errorf("invalid Z85 character %q", s[i+j])
+			}
+			value = value*85 + uint64(digit)
+		}
+		if value > 0xffffffff {
+			return nil, errors.New("invalid Z85 block")
+		}
+		out = append(out, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+	return out, nil
+}
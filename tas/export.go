@@ -0,0 +1,239 @@
+package tas
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/chango/tas/tree"
+)
+
+// Exports the keys matching Pattern as series of the metric named by Name.
+// Pattern is a dotted key whose segments are literals, * or captures such
+// as {host}, which all match a single segment. Name may contain captures,
+// ie/ "cart_{section}_items"; the captures it does not use become labels.
+// Keys that end up as the same series, ie/ keys told apart by a * only, are
+// summed.
+type ExportRule struct {
+	Pattern string // ie/ "cart.{section}.{basket}"
+	Name    string // Metric name template, ie/ "cart_{section}"
+	Help    string // Description of the metric (optional)
+}
+
+// A segment of a compiled export pattern
+type exportSegment struct {
+	literal string
+	capture string // Name of the capture, empty for literals and *
+	any     bool
+}
+
+// Returns the segments of an export pattern
+func parseExportPattern(pattern string) ([]exportSegment, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("export pattern is empty")
+	}
+	var segments []exportSegment
+	for _, s := range strings.Split(pattern, ".") {
+		switch {
+		case s == "*":
+			segments = append(segments, exportSegment{any: true})
+		case strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") && len(s) > 2:
+			name := s[1 : len(s)-1]
+			if sanitizeMetricName(name) != name || strings.Contains(name, ":") {
+				return nil, fmt.Errorf("export pattern %q: capture {%s} is not a valid label name", pattern, name)
+			}
+			segments = append(segments, exportSegment{capture: name, any: true})
+		case s == "" || strings.ContainsAny(s, "{}"):
+			return nil, fmt.Errorf("export pattern %q has an invalid segment %q", pattern, s)
+		default:
+			segments = append(segments, exportSegment{literal: s})
+		}
+	}
+	return segments, nil
+}
+
+// Checks the export rules of the configuration
+func checkExportRules(rules []ExportRule) error {
+	for _, rule := range rules {
+		segments, err := parseExportPattern(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		if rule.Name == "" {
+			return fmt.Errorf("export pattern %q has no metric name", rule.Pattern)
+		}
+		captures := make(map[string]string)
+		for _, s := range segments {
+			if s.capture != "" {
+				captures[s.capture] = "x"
+			}
+		}
+		name := expandTemplate(rule.Name, captures)
+		if strings.ContainsAny(name, "{}") {
+			return fmt.Errorf("export metric name %q refers to a capture that is not in %q", rule.Name, rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// Replaces the {capture} references in a template
+func expandTemplate(template string, captures map[string]string) string {
+	for name, value := range captures {
+		template = strings.Replace(template, "{"+name+"}", value, -1)
+	}
+	return template
+}
+
+// Replaces the characters that are not allowed in metric names with _
+func sanitizeMetricName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		ok := c == '_' || c == ':' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9'
+		if !ok {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+// A metric family exported from the tree
+type exportFamily struct {
+	help    string
+	samples map[string]float64  // Value by rendered label set, ie/ {basket="basket1"}
+	keys    map[*tree.Node]bool // Keys already added to the samples
+}
+
+// Renders the keys matched by the export rules as OpenMetrics gauges
+// whose value is the aggregate of the current window, as /GET returns it
+func (t *TASServer) exportMetrics(rules []ExportRule, intervalSeconds float64) []byte {
+	families := make(map[string]*exportFamily)
+
+	t.pfdTree.RLock()
+	for _, rule := range rules {
+		segments, err := parseExportPattern(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		matchExport(t.pfdTree.DataNode, segments, map[string]string{}, func(node *tree.Node, captures map[string]string) {
+			value, ok := exportValue(node.GetValue(nil, nil, intervalSeconds))
+			if !ok {
+				return
+			}
+			name := sanitizeMetricName(expandTemplate(rule.Name, captures))
+			var labelNames []string
+			for capture := range captures {
+				if !strings.Contains(rule.Name, "{"+capture+"}") {
+					labelNames = append(labelNames, capture)
+				}
+			}
+			sort.Strings(labelNames)
+			var labels []string
+			for _, label := range labelNames {
+				labels = append(labels, fmt.Sprintf("%s=\"%s\"", label, escapeLabel(captures[label])))
+			}
+			labelSet := ""
+			if len(labels) > 0 {
+				labelSet = "{" + strings.Join(labels, ",") + "}"
+			}
+
+			family, ok := families[name]
+			if !ok {
+				family = &exportFamily{help: rule.Help, samples: make(map[string]float64), keys: make(map[*tree.Node]bool)}
+				families[name] = family
+			}
+			// A key matched by several rules is only counted once
+			if !family.keys[node] {
+				family.keys[node] = true
+				family.samples[labelSet] += value
+			}
+		})
+	}
+	t.pfdTree.RUnlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		family := families[name]
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		if family.help != "" {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", name, escapeLabel(family.help))
+		}
+		labelSets := make([]string, 0, len(family.samples))
+		for labelSet := range family.samples {
+			labelSets = append(labelSets, labelSet)
+		}
+		sort.Strings(labelSets)
+		for _, labelSet := range labelSets {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, labelSet, formatSample(family.samples[labelSet]))
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Bytes()
+}
+
+// Calls found for every node under n that matches the segments
+func matchExport(n *tree.Node, segments []exportSegment, captures map[string]string, found func(*tree.Node, map[string]string)) {
+	if len(segments) == 0 {
+		found(n, captures)
+		return
+	}
+	s := segments[0]
+	if !s.any {
+		if c := n.GetChild(s.literal); c != nil {
+			matchExport(c, segments[1:], captures, found)
+		}
+		return
+	}
+	for key, c := range n.Children {
+		// Timestamp children hold the values of a key, not key segments
+		if c.HasValue() {
+			continue
+		}
+		next := captures
+		if s.capture != "" {
+			next = make(map[string]string, len(captures)+1)
+			for k, v := range captures {
+				next[k] = v
+			}
+			next[s.capture] = key
+		}
+		matchExport(c, segments[1:], next, found)
+	}
+}
+
+// Returns the value of a key as a sample value. Keys of APPEND data have
+// no numeric value and are not exported.
+func exportValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// OpenMetrics endpoint with the keys selected by ExportRules
+func (t *TASServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	var intervalSeconds float64 = 5.0
+	if r.FormValue("i") != "" {
+		i, err := strconv.ParseFloat(r.FormValue("i"), 64)
+		if err != nil || !(i > 0) || math.IsInf(i, 0) {
+			http.Error(w, fmt.Sprintf("i %q is not a positive number of seconds", r.FormValue("i")), http.StatusBadRequest)
+			return
+		}
+		intervalSeconds = i
+	}
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write(t.exportMetrics(t.conf().ExportRules, intervalSeconds))
+}
@@ -0,0 +1,143 @@
+package tas
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/chango/tas/tree"
+)
+
+// Output formats of value queries
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// Media types of the output formats
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+}
+
+// Returns the output format of a value query: the format parameter if it
+// is given, otherwise the first of the formats in the Accept header when
+// negotiate is set, otherwise JSON
+func queryFormat(r *http.Request, negotiate bool) (string, *apiError) {
+	if format := r.FormValue("format"); format != "" {
+		if _, ok := formatTypes[format]; !ok {
+			return "", newAPIError(http.StatusBadRequest, "bad_parameter", "format %q is not %q, %q or %q", format, formatJSON, formatCSV, formatNDJSON)
+		}
+		return format, nil
+	}
+	if negotiate {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+			switch mediaType {
+			case "text/csv":
+				return formatCSV, nil
+			case "application/x-ndjson", "application/ndjson":
+				return formatNDJSON, nil
+			case "application/json":
+				return formatJSON, nil
+			}
+		}
+	}
+	return formatJSON, nil
+}
+
+// Returns whether a value query asks for a row per bucket with buckets=true
+func queryBuckets(r *http.Request) (bool, *apiError) {
+	if r.FormValue("buckets") == "" {
+		return false, nil
+	}
+	buckets, err := strconv.ParseBool(r.FormValue("buckets"))
+	if err != nil {
+		return false, newAPIError(http.StatusBadRequest, "bad_parameter", "buckets %q is not true or false", r.FormValue("buckets"))
+	}
+	return buckets, nil
+}
+
+// A row in the JSON and NDJSON formats
+type jsonRow struct {
+	Key       string      `json:"key"`
+	Timestamp json.Number `json:"timestamp,omitempty"`
+	Value     interface{} `json:"value"`
+}
+
+func newJSONRows(rows []tree.Row) []jsonRow {
+	out := make([]jsonRow, len(rows))
+	for i, row := range rows {
+		out[i] = jsonRow{Key: row.Key, Timestamp: json.Number(row.Timestamp), Value: row.Value}
+	}
+	return out
+}
+
+// Renders rows as CSV with a key,timestamp,value header, or as NDJSON with
+// an object per line. The timestamp is empty for the value of all buckets.
+// CSV keys that a spreadsheet would run as a formula are escaped.
+func renderRows(format string, rows []tree.Row) ([]byte, error) {
+	var buf bytes.Buffer
+	if format == formatNDJSON {
+		encoder := json.NewEncoder(&buf)
+		for _, row := range newJSONRows(rows) {
+			if err := encoder.Encode(row); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"key", "timestamp", "value"})
+	for _, row := range rows {
+		value, err := formatRowValue(row.Value)
+		if err != nil {
+			return nil, err
+		}
+		writer.Write([]string{escapeCSVFormula(row.Key), row.Timestamp, value})
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// Prefixes a CSV field with ' when it starts with a character that makes
+// spreadsheets read it as a formula. Values are not escaped, as TAS writes
+// them and a negative number must stay a number.
+func escapeCSVFormula(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+// Returns a value as a CSV field: numbers as they are, lists as JSON
+func formatRowValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	}
+	returnVal, err := json.Marshal(v)
+	return string(returnVal), err
+}
+
+// Writes rows in format, which is CSV or NDJSON
+func writeRows(w http.ResponseWriter, format string, rows []tree.Row) {
+	body, err := renderRows(format, rows)
+	if err != nil {
+		writeAPIError(w, newAPIError(http.StatusInternalServerError, "internal", "Could not encode the response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", formatTypes[format])
+	w.Write(body)
+}
@@ -0,0 +1,214 @@
+package tas
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How values of a Graphite path are stored
+const (
+	GraphiteSum   = "sum"   // INCR of the value, which must be an integer
+	GraphiteGauge = "gauge" // GAUGE of the value
+)
+
+// Value semantics for the Graphite paths under Prefix
+type GraphiteRule struct {
+	Prefix string // Dotted path prefix, e.g. "servers.web"
+	Mode   string // GraphiteSum or GraphiteGauge
+}
+
+// Translates lines of Graphite's plaintext protocol, "path value timestamp",
+// into TAS messages using the mode of the longest matching rule
+type graphiteParser struct {
+	rules       []GraphiteRule
+	defaultMode string
+}
+
+// Returns the mode for path
+func (p *graphiteParser) mode(path string) string {
+	mode, longest := p.defaultMode, -1
+	for _, rule := range p.rules {
+		if len(rule.Prefix) > longest && (path == rule.Prefix || strings.HasPrefix(path, rule.Prefix+".")) {
+			mode, longest = rule.Mode, len(rule.Prefix)
+		}
+	}
+	return mode
+}
+
+func (p *graphiteParser) parse(line string) (m Message, ingestErr *IngestError) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return m, reject(ReasonMalformed, "expected path value timestamp, got %d fields", len(fields))
+	}
+	m = Message{Key: fields[0], Timestamp: fields[2]}
+
+	// Carbon accepts -1 for the time it receives the line
+	if m.Timestamp == "-1" {
+		m.Timestamp = TimestampNow
+	}
+
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return m, reject(ReasonBadValue, "value is not a number: %q", fields[1])
+	}
+	if p.mode(m.Key) == GraphiteSum {
+		// Sums are integers, rounding would silently lose the fractions
+		if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+			return m, reject(ReasonBadValue, "sum value is not an integer: %q", fields[1])
+		}
+		m.Verb, m.Value = "INCR", int(v)
+	} else {
+		m.Verb, m.Value = "GAUGE", v
+	}
+	return m, nil
+}
+
+// Processes a Graphite line and records whether it was accepted
+func (t *TASServer) processGraphite(line string) *IngestError {
+	c := t.conf()
+	parser := graphiteParser{rules: c.GraphiteRules, defaultMode: c.GraphiteDefaultMode}
+	m, err := parser.parse(line)
+	if err == nil {
+		err = t.ingest(m)
+	}
+	if err != nil {
+		t.logMessage("Rejected Graphite line", "line", line, "reason", err.Reason, "error", err.Err)
+	}
+	t.stats.record(m.Verb, line, err)
+	return err
+}
+
+// Opens the TCP and UDP sockets of the Graphite listener
+func (t *TASServer) listenGraphite() (err error) {
+	addr := fmt.Sprintf("%s:%s", t.config.GraphiteAddress, t.config.GraphitePort)
+	t.graphiteListener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen for Graphite on tcp %s: %v", addr, err)
+	}
+	// Listen for UDP on the same port, also when port 0 picked one for TCP
+	port := t.graphiteListener.Addr().(*net.TCPAddr).Port
+	addr = net.JoinHostPort(t.config.GraphiteAddress, strconv.Itoa(port))
+	t.graphiteConn, err = net.ListenPacket("udp", addr)
+	if err != nil {
+		t.graphiteListener.Close()
+		return fmt.Errorf("Could not listen for Graphite on udp %s: %v", addr, err)
+	}
+	t.graphiteConns = make(map[net.Conn]bool)
+	return nil
+}
+
+// Returns the address of the Graphite listener, which listens for TCP and
+// UDP on the same port, nil when it is disabled
+func (t *TASServer) GraphiteAddr() net.Addr {
+	if t.graphiteListener == nil {
+		return nil
+	}
+	return t.graphiteListener.Addr()
+}
+
+// Graphite TCP acceptor
+func (t *TASServer) graphiteAcceptor() {
+	t.log.Info("Starting Graphite receiver", "addr", t.graphiteListener.Addr().String())
+	for {
+		conn, err := t.graphiteListener.Accept()
+		if t.closing.Load() {
+			return
+		}
+		if err != nil {
+			t.log.Warn("Graphite accept error", "error", err)
+			continue
+		}
+		t.spawn(func() { t.graphiteReceiver(conn) })
+	}
+}
+
+// Reads lines from a Graphite TCP connection until it is closed, goes idle
+// or sends a line that is too long
+func (t *TASServer) graphiteReceiver(conn net.Conn) {
+	t.graphiteMu.Lock()
+	if max := t.conf().GraphiteMaxConnections; max > 0 && len(t.graphiteConns) >= max {
+		t.graphiteMu.Unlock()
+		t.log.Warn("Refusing Graphite connection over the limit", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	t.graphiteConns[conn] = true
+	t.graphiteMu.Unlock()
+	defer func() {
+		t.graphiteMu.Lock()
+		delete(t.graphiteConns, conn)
+		t.graphiteMu.Unlock()
+		conn.Close()
+	}()
+	if t.closing.Load() {
+		// Accepted while closing, after the open connections were closed
+		return
+	}
+
+	scanner := bufio.NewScanner(&idleReader{conn: conn, timeout: t.conf().GraphiteIdleTimeout})
+	if max := t.conf().GraphiteMaxLineBytes; max > 0 {
+		size := 4096
+		if max < size {
+			size = max
+		}
+		scanner.Buffer(make([]byte, 0, size), max)
+	}
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			t.processGraphite(line)
+		}
+	}
+	if err := scanner.Err(); err != nil && !t.closing.Load() {
+		t.log.Warn("Graphite connection error", "remote", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// Reads from a connection, failing with a timeout when no data arrives
+// within the idle timeout of any read
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration // 0 to wait forever
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.conn.Read(p)
+}
+
+// Graphite UDP receiver
+func (t *TASServer) graphitePacketReceiver() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, _, err := t.graphiteConn.ReadFrom(buf)
+		if t.closing.Load() {
+			return
+		}
+		if err != nil {
+			t.log.Warn("Graphite receive error", "error", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				t.processGraphite(line)
+			}
+		}
+	}
+}
+
+// Closes the Graphite sockets and connections
+func (t *TASServer) closeGraphite() {
+	t.graphiteListener.Close()
+	t.graphiteConn.Close()
+	t.graphiteMu.Lock()
+	defer t.graphiteMu.Unlock()
+	for conn := range t.graphiteConns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package tas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// How late the GC may tick before /readyz reports it as stalled, on top
+// of GCInterval
+const gcTickGrace = 10 * time.Second
+
+// Outcome of one health or readiness check
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Returns the checks that tell whether the process is alive and its
+// listeners are bound
+func (t *TASServer) healthChecks() []healthCheck {
+	closing := t.closing.Load()
+	var listeners []string
+	if t.httpListener != nil {
+		listeners = append(listeners, "http "+t.httpListener.Addr().String())
+	}
+	if t.tcp != nil {
+		listeners = append(listeners, "tcp "+t.tcp.Addr().String())
+	}
+	if t.statsdConn != nil {
+		listeners = append(listeners, "statsd "+t.statsdConn.LocalAddr().String())
+	}
+	if t.graphiteListener != nil {
+		listeners = append(listeners, "graphite "+t.graphiteListener.Addr().String())
+	}
+	detail := strings.Join(listeners, ", ")
+	if closing {
+		detail = "closed"
+	}
+	return []healthCheck{
+		{Name: "process", OK: true, Detail: fmt.Sprintf("%d goroutines", runtime.NumGoroutine())},
+		{Name: "listeners", OK: !closing, Detail: detail},
+	}
+}
+
+// Returns the checks that tell whether the server ingests messages and
+// keeps its data in check
+func (t *TASServer) readyChecks() []healthCheck {
+	c := t.conf()
+	var checks []healthCheck
+
+	t.mu.Lock()
+	started := t.started
+	t.mu.Unlock()
+	switch {
+	case t.closing.Load():
+		checks = append(checks, healthCheck{Name: "ingest", Detail: "shutting down"})
+	case !started:
+		checks = append(checks, healthCheck{Name: "ingest", Detail: "not started"})
+	default:
+		serving := int(t.serving.Load())
+		checks = append(checks, healthCheck{
+			Name:   "ingest",
+			OK:     serving == len(t.transports),
+			Detail: fmt.Sprintf("%d of %d transports serving", serving, len(t.transports)),
+		})
+	}
+
+	gc := healthCheck{Name: "gc"}
+	if last := t.metrics.lastGC(); last.IsZero() {
+		gc.Detail = "the GC has not run yet"
+	} else {
+		age := time.Since(last)
+		gc.OK = age <= c.GCInterval+gcTickGrace
+		gc.Detail = fmt.Sprintf("last run %s ago, every %s", age.Round(time.Millisecond), c.GCInterval)
+	}
+	checks = append(checks, gc)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	memory := healthCheck{Name: "memory", OK: true, Detail: fmt.Sprintf("%d heap bytes in use, no budget", m.HeapAlloc)}
+	if c.MemoryBudget > 0 {
+		memory.OK = m.HeapAlloc <= uint64(c.MemoryBudget)
+		memory.Detail = fmt.Sprintf("%d heap bytes in use of %d", m.HeapAlloc, c.MemoryBudget)
+	}
+	return append(checks, memory)
+}
+
+// Writes the outcome of checks as JSON, with a 503 status if any failed
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+	returnVal, e := json.Marshal(map[string]interface{}{"status": status, "checks": checks})
+	if e != nil {
+		returnVal = []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(returnVal)
+}
+
+// Liveness probe: the process answers and its listeners are bound
+func (t *TASServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, t.healthChecks())
+}
+
+// Readiness probe: the transports are being served, the GC ticks on time
+// and the heap is within MemoryBudget
+func (t *TASServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, t.readyChecks())
+}
@@ -0,0 +1,66 @@
+// Bar chart of the timestamp counts that /DIAG returns, refreshed every second
+
+var svg = dimple.newSvg("#chartContainer", "100%", "100%");
+
+var ajax_data = getData();
+document.getElementById("server_time").innerHTML=ajax_data[1];
+var js_string = "{ \"data\": [".concat(ajax_data[0], "]}")
+var js = JSON.parse(js_string)
+
+
+
+var myChart = new dimple.chart(svg, []);
+myChart.data = js.data
+
+var x = myChart.addMeasureAxis("x", "count");
+var y = myChart.addCategoryAxis("y", "timestamp");
+y.addOrderRule("timestamp");
+var s = myChart.addSeries(null, dimple.plot.area);
+s.interpolation = "step";
+s.lineWeight = 1;
+myChart.draw();
+
+function refresh(myChart) {
+
+      var ajax_data = getData();
+
+      document.getElementById("server_time").innerHTML=ajax_data[1];
+
+      var js_string = "{ \"data\": [".concat(ajax_data[0], "]}")
+      var js = JSON.parse(js_string)
+      myChart.data = js.data
+      myChart.draw(1000);
+}
+
+
+
+var myVar = setInterval(function(){refresh(myChart)},1000);
+var isPaused = false;
+function pause_resume(){
+  if(!isPaused){  //pause is clicked
+    clearInterval(myVar)
+    document.getElementById("pause_resume").value="resume";
+    isPaused = true;
+  }else{  //resume is clicked
+    myVar = setInterval(function(){refresh(myChart)},1000);
+    document.getElementById("pause_resume").value="pause";
+    isPaused = false;
+  }
+}
+
+function getData() {
+    var result = null
+    var server_time = 0
+    $.ajax({
+      url: "DIAG", // Relative to this page, so it follows the port and path prefix
+      type: 'get',
+      dataType: 'html',
+      async: false,
+      success: function(data){
+        var js = JSON.parse(data);
+        result = js.ts_counts;
+        server_time = js.current_time;
+      }
+    });
+  return [result, server_time];
+};
@@ -1,34 +1,4 @@
-<html>
-<head>
-<style>
-
-.node {
-  cursor: pointer;
-}
-
-.node circle {
-  fill: #fff;
-  stroke: steelblue;
-  stroke-width: 2px;
-}
-
-.node text {
-  font: 10px sans-serif;
-}
-
-.link {
-  fill: none;
-  stroke: #ccc;
-  stroke-width: 1.5px;
-}
-
-</style>
-
-</head>
-<body>
-  <script src="http://d3js.org/d3.v3.min.js"></script>
-
-<script>
+// Collapsible tree of the data in treeData, set by the TREE page
 
 var margin = {top: 20, right: 120, bottom: 20, left: 120},
     width = 1400 - margin.right - margin.left,
@@ -50,10 +20,6 @@ var svg = d3.select("body").append("svg")
   .append("g")
     .attr("transform", "translate(" + margin.left + "," + margin.top + ")");
 
-var treeData = [
- {{template "Tree"}}
-];
-
 d3.json(treeData, function(error, flare) {
   root = treeData[0];
   root.x0 = height / 2;
@@ -171,7 +137,3 @@ function click(d) {
   }
   update(d);
 }
-
-</script>
-</body>
-</html>
\ No newline at end of file
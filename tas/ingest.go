@@ -0,0 +1,200 @@
+package tas
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Reasons an incoming message can be rejected
+const (
+	ReasonMalformed    = "malformed"
+	ReasonBadVerb      = "bad_verb"
+	ReasonBadTimestamp = "bad_timestamp"
+	ReasonBadValue     = "bad_value"
+	ReasonTypeConflict = "type_conflict"
+	ReasonPanic        = "panic"
+)
+
+// Error returned when a message is rejected by the server
+type IngestError struct {
+	Reason string
+	Err    error
+}
+
+func (e *IngestError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func reject(reason string, format string, v ...interface{}) *IngestError {
+	return &IngestError{Reason: reason, Err: fmt.Errorf(format, v...)}
+}
+
+// Outcome of a single message of a batch
+type IngestResult struct {
+	Line   int    `json:"line"` // Line, record or array index in the batch, starting at 1
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newIngestResult(line int, err *IngestError) IngestResult {
+	if err == nil {
+		return IngestResult{Line: line, OK: true}
+	}
+	return IngestResult{Line: line, Reason: err.Reason, Error: err.Err.Error()}
+}
+
+// Longest raw message kept in a dead letter. Longer messages are cut, so
+// that the dead letters take at most DeadLetterSize times this much memory.
+const deadLetterMessageBytes = 1024
+
+// A rejected raw message kept for inspection
+type DeadLetter struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Reason  string    `json:"reason"`
+	Error   string    `json:"error"`
+}
+
+// Counters for accepted and rejected messages along with a bounded ring
+// of the most recently rejected messages
+type ingestStats struct {
+	mu       sync.Mutex
+	received uint64
+	accepted uint64
+	rejected map[string]uint64
+	adjusted map[string]uint64
+	outcomes map[verbOutcome]uint64
+	dead     []DeadLetter
+	next     int
+	full     bool
+}
+
+func newIngestStats(deadLetterSize int) *ingestStats {
+	if deadLetterSize < 0 {
+		deadLetterSize = 0
+	}
+	return &ingestStats{
+		rejected: make(map[string]uint64),
+		adjusted: make(map[string]uint64),
+		outcomes: make(map[verbOutcome]uint64),
+		dead:     make([]DeadLetter, deadLetterSize),
+	}
+}
+
+// Verb of a message and the reason it was rejected, empty if accepted
+type verbOutcome struct {
+	verb   string
+	reason string
+}
+
+// Records the outcome of processing rawMessage with verb, which may be
+// empty when the message could not be decoded. err is nil when the
+// message was accepted.
+func (s *ingestStats) record(verb, rawMessage string, err *IngestError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only known verbs are counted by name to keep the number of counters bounded
+	if verb != "INCR" && verb != "APPEND" && verb != "GAUGE" {
+		verb = "unknown"
+	}
+	s.received++
+	if err == nil {
+		s.accepted++
+		s.outcomes[verbOutcome{verb, ""}]++
+		return
+	}
+	s.rejected[err.Reason]++
+	s.outcomes[verbOutcome{verb, err.Reason}]++
+
+	if len(s.dead) == 0 {
+		return
+	}
+	s.dead[s.next] = DeadLetter{
+		Time:    time.Now(),
+		Message: truncateMessage(rawMessage),
+		Reason:  err.Reason,
+		Error:   err.Err.Error(),
+	}
+	s.next = (s.next + 1) % len(s.dead)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// Returns rawMessage cut to deadLetterMessageBytes, on a character
+// boundary, followed by the number of bytes that were cut
+func truncateMessage(rawMessage string) string {
+	if len(rawMessage) <= deadLetterMessageBytes {
+		return rawMessage
+	}
+	n := deadLetterMessageBytes
+	for n > 0 && !utf8.RuneStart(rawMessage[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", rawMessage[:n], len(rawMessage)-n)
+}
+
+// Returns the number of received and accepted messages, and a copy of
+// the rejection counts by reason
+func (s *ingestStats) counts() (received, accepted uint64, rejected map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rejected = make(map[string]uint64, len(s.rejected))
+	for reason, n := range s.rejected {
+		rejected[reason] = n
+	}
+	return s.received, s.accepted, rejected
+}
+
+// Returns a copy of the message counts by verb and outcome
+func (s *ingestStats) verbOutcomes() map[verbOutcome]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	outcomes := make(map[verbOutcome]uint64, len(s.outcomes))
+	for outcome, n := range s.outcomes {
+		outcomes[outcome] = n
+	}
+	return outcomes
+}
+
+// Counts a message that was accepted with an adjusted timestamp
+func (s *ingestStats) adjust(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.adjusted[kind]++
+}
+
+// Returns a copy of the timestamp adjustment counts by kind
+func (s *ingestStats) adjustments() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	adjusted := make(map[string]uint64, len(s.adjusted))
+	for kind, n := range s.adjusted {
+		adjusted[kind] = n
+	}
+	return adjusted
+}
+
+// Returns the dead letters, newest first
+func (s *ingestStats) deadLetters() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.next
+	if s.full {
+		n = len(s.dead)
+	}
+	letters := make([]DeadLetter, 0, n)
+	for i := 1; i <= n; i++ {
+		letters = append(letters, s.dead[(s.next-i+len(s.dead))%len(s.dead)])
+	}
+	return letters
+}
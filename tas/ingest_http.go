@@ -0,0 +1,140 @@
+package tas
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// A message in the JSON form of the ingestion protocol, e.g.
+// {"verb": "INCR", "timestamp": 1404148628, "key": "cart.seafood", "value": 5}
+type jsonMessage struct {
+	Verb      string          `json:"verb"`
+	Timestamp json.RawMessage `json:"timestamp"` // String or number, the server time if missing
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// Response of the HTTP ingestion endpoint
+type ingestResponse struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []IngestResult `json:"results"`
+}
+
+// HTTP ingestion endpoint. Accepts a POST with a single message, a newline
+// separated batch or a binary frame, or a JSON array of messages, and
+// returns the outcome of every message.
+func (t *TASServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	response, apiErr := t.ingestRequest(w, r)
+	if apiErr != nil {
+		writePlainError(w, apiErr)
+		return
+	}
+	returnVal, e := json.Marshal(response)
+	if e != nil {
+		returnVal = []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(returnVal))
+}
+
+// Processes the messages of an ingestion request
+func (t *TASServer) ingestRequest(w http.ResponseWriter, r *http.Request) (*ingestResponse, *apiError) {
+	if r.Method != "POST" {
+		return nil, methodNotAllowed("POST")
+	}
+
+	reader := r.Body
+	if maxBytes := t.conf().HTTPIngestMaxBytes; maxBytes > 0 {
+		reader = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return nil, newAPIError(http.StatusRequestEntityTooLarge, "too_large", "Error reading body: %v", err)
+		}
+		return nil, newAPIError(http.StatusBadRequest, "bad_body", "Error reading body: %v", err)
+	}
+
+	var results []IngestResult
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" || bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(body, &elements); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "bad_body", "Body is not a JSON array: %v", err)
+		}
+		results = t.processJSON(elements)
+	} else {
+		results = t.processBatch(body)
+	}
+
+	response := &ingestResponse{Results: results}
+	for _, result := range results {
+		if result.OK {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+	return response, nil
+}
+
+// Processes the elements of a JSON array of messages
+func (t *TASServer) processJSON(elements []json.RawMessage) []IngestResult {
+	results := make([]IngestResult, 0, len(elements))
+	for i, element := range elements {
+		m, err := decodeJSON(element)
+		if err != nil {
+			t.stats.record(m.Verb, string(element), err)
+			results = append(results, newIngestResult(i+1, err))
+			continue
+		}
+		results = append(results, newIngestResult(i+1, t.processMessage(m)))
+	}
+	return results
+}
+
+// Decodes a message in the JSON form of the protocol
+func decodeJSON(element json.RawMessage) (m Message, ingestErr *IngestError) {
+	var jm jsonMessage
+	if err := json.Unmarshal(element, &jm); err != nil {
+		return m, reject(ReasonMalformed, "message is not a JSON object: %v", err)
+	}
+	m = Message{Verb: jm.Verb, Key: jm.Key, Timestamp: TimestampNow}
+
+	if len(jm.Timestamp) > 0 {
+		if err := json.Unmarshal(jm.Timestamp, &m.Timestamp); err != nil {
+			// Not a string, use the number as written
+			m.Timestamp = strings.TrimSpace(string(jm.Timestamp))
+		}
+	}
+
+	switch m.Verb {
+	case "INCR":
+		var v int
+		if err := json.Unmarshal(jm.Value, &v); err != nil {
+			return m, reject(ReasonBadValue, "INCR value is not an integer: %s", jm.Value)
+		}
+		m.Value = v
+	case "APPEND":
+		var data interface{}
+		if err := json.Unmarshal(jm.Value, &data); err != nil {
+			return m, reject(ReasonBadValue, "APPEND value is not valid JSON: %v", err)
+		}
+		m.Value = data
+	case "GAUGE":
+		var v float64
+		if err := json.Unmarshal(jm.Value, &v); err != nil {
+			return m, reject(ReasonBadValue, "GAUGE value is not a number: %s", jm.Value)
+		}
+		m.Value = v
+	default:
+		return m, reject(ReasonBadVerb, "unknown verb %q", m.Verb)
+	}
+	return m, nil
+}
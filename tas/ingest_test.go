@@ -0,0 +1,45 @@
+package tas
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIngestStats(t *testing.T) {
+	// Rejections are counted by reason and the newest ones are kept
+
+	for _, size := range []int{0, 1, 3} {
+		s := newIngestStats(size)
+		s.record("INCR", "INCR 1 key 1", nil)
+		for _, message := range []string{"a", "b", "c", "d"} {
+			s.record("", message, &IngestError{Reason: ReasonBadVerb, Err: errors.New(message)})
+		}
+		s.record("INCR", "e", &IngestError{Reason: ReasonMalformed, Err: errors.New("e")})
+
+		received, accepted, rejected := s.counts()
+		if received != 6 || accepted != 1 || rejected[ReasonBadVerb] != 4 || rejected[ReasonMalformed] != 1 {
+			t.Errorf("Size %d counted %d %d %v", size, received, accepted, rejected)
+		}
+		var kept []string
+		for _, letter := range s.deadLetters() {
+			kept = append(kept, letter.Message)
+		}
+		if expected := "edcba"[:size]; strings.Join(kept, "") != expected {
+			t.Errorf("Size %d kept %v instead of %q", size, kept, expected)
+		}
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	// Long messages are cut on a character boundary
+
+	short := strings.Repeat("x", deadLetterMessageBytes)
+	if truncateMessage(short) != short {
+		t.Error("Message of the maximum length was cut")
+	}
+	long := strings.Repeat("x", deadLetterMessageBytes-1) + "é" + strings.Repeat("x", 100)
+	if cut := truncateMessage(long); cut != strings.Repeat("x", deadLetterMessageBytes-1)+"... (102 more bytes)" {
+		t.Errorf("Long message cut to %q", cut[deadLetterMessageBytes-10:])
+	}
+}
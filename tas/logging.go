@@ -0,0 +1,144 @@
+package tas
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Levels of LogLevel
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+)
+
+// Formats of LogFormat
+const (
+	LogLogfmt = "logfmt"
+	LogJSON   = "json"
+)
+
+// Returns the default log level, which the DEBUG=1 environment variable
+// of earlier versions still lowers to debug
+func defaultLogLevel() string {
+	if os.Getenv("DEBUG") == "1" {
+		return LogDebug
+	}
+	return LogInfo
+}
+
+// Returns the slog level of a LogLevel
+func parseLogLevel(level string) (slog.Level, error) {
+	switch level {
+	case LogDebug:
+		return slog.LevelDebug, nil
+	case LogInfo, "":
+		return slog.LevelInfo, nil
+	case LogWarn:
+		return slog.LevelWarn, nil
+	case LogError:
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("%q is not %q, %q, %q or %q", level, LogDebug, LogInfo, LogWarn, LogError)
+}
+
+// Checks the logging settings of the configuration
+func checkLogging(c *TASConfig) error {
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return settingErrorf("LogLevel", "%v", err)
+	}
+	if c.LogFormat != "" && c.LogFormat != LogLogfmt && c.LogFormat != LogJSON {
+		return settingErrorf("LogFormat", "%q is not %q or %q", c.LogFormat, LogLogfmt, LogJSON)
+	}
+	if c.LogSampleFirst < 0 {
+		return settingErrorf("LogSampleFirst", "must not be negative")
+	}
+	if c.LogSampleThereafter < 0 {
+		return settingErrorf("LogSampleThereafter", "must not be negative")
+	}
+	return nil
+}
+
+// Returns the logger of a server: Logger from the configuration if it is
+// set, otherwise one that writes to LogOutput in LogFormat. The level of a
+// logger built here can be changed through level.
+func newLogger(c *TASConfig, level *slog.LevelVar) (*slog.Logger, io.Closer, error) {
+	l, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	level.Set(l)
+	if c.Logger != nil {
+		return c.Logger, nil, nil
+	}
+
+	var out io.Writer
+	var closer io.Closer
+	switch c.LogOutput {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(c.LogOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not open log file: %v", err)
+		}
+		out, closer = f, f
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if c.LogFormat == LogJSON {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	return slog.New(handler), closer, nil
+}
+
+// Limits the records logged for individual messages, which can be as many
+// as the messages received: the first records of every second with the
+// same log message are logged, then one in every thereafter
+type logSampler struct {
+	first      int
+	thereafter int
+
+	mu     sync.Mutex
+	second int64
+	counts map[string]int
+}
+
+// Returns whether the next record with the log message msg should be logged
+func (s *logSampler) allow(msg string) bool {
+	if s.first <= 0 && s.thereafter <= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now := time.Now().Unix(); now != s.second || s.counts == nil {
+		s.second, s.counts = now, make(map[string]int)
+	}
+	s.counts[msg]++
+	count := s.counts[msg]
+	if count <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (count-s.first)%s.thereafter == 0
+}
+
+// Logs a record about an individual message at debug level, subject to
+// sampling
+func (t *TASServer) logMessage(msg string, args ...interface{}) {
+	if !t.log.Enabled(context.Background(), slog.LevelDebug) || !t.sampler.allow(msg) {
+		return
+	}
+	t.log.Debug(msg, args...)
+}
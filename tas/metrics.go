@@ -0,0 +1,337 @@
+package tas
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// Cumulative histogram in the Prometheus sense
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // Observations in each bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// Internal metrics of the server that ingestStats does not keep
+type serverMetrics struct {
+	ingestLatency *histogram
+	gcDuration    *histogram
+
+	mu           sync.Mutex
+	gcRuns       uint64
+	gcFreed      uint64
+	gcLast       time.Time // When the last GC run finished
+	httpRequests map[httpRequest]uint64
+	httpLatency  map[string]*histogram
+}
+
+// Endpoint and status code of HTTP requests
+type httpRequest struct {
+	endpoint string
+	code     int
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		ingestLatency: newHistogram(latencyBuckets),
+		gcDuration:    newHistogram(latencyBuckets),
+		httpRequests:  make(map[httpRequest]uint64),
+		httpLatency:   make(map[string]*histogram),
+	}
+}
+
+// Records a GC run
+func (m *serverMetrics) gc(duration time.Duration, freed int) {
+	m.gcDuration.observe(duration.Seconds())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gcRuns++
+	m.gcFreed += uint64(freed)
+	m.gcLast = time.Now()
+}
+
+// Returns when the last GC run finished, zero if the GC never ran
+func (m *serverMetrics) lastGC() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gcLast
+}
+
+// Records an HTTP request
+func (m *serverMetrics) http(endpoint string, code int, duration time.Duration) {
+	m.mu.Lock()
+	m.httpRequests[httpRequest{endpoint, code}]++
+	h, ok := m.httpLatency[endpoint]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.httpLatency[endpoint] = h
+	}
+	m.mu.Unlock()
+	h.observe(duration.Seconds())
+}
+
+// Records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Wraps the mux of the HTTP pages to count the requests and their latency
+// by endpoint. Paths that match no page are counted as "other".
+func (t *TASServer) instrument(mux *http.ServeMux, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, pattern := mux.Handler(r)
+		endpoint := strings.TrimPrefix(pattern, prefix)
+		if endpoint == "" {
+			endpoint = "other"
+		}
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+		t.metrics.http(endpoint, recorder.code, time.Since(start))
+	})
+}
+
+// Writes metrics in the Prometheus text exposition format
+type promWriter struct {
+	buf bytes.Buffer
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	fmt.Fprintf(&p.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes a sample; labels are pairs of names and values
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.buf.WriteString(name)
+	if len(labels) > 0 {
+		p.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&p.buf, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(formatSample(value))
+	p.buf.WriteByte('\n')
+}
+
+func (p *promWriter) histogram(name string, h *histogram, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		p.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatSample(bound))...)
+	}
+	p.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	p.sample(name+"_sum", h.sum, labels...)
+	p.sample(name+"_count", float64(h.count), labels...)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatSample(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Prometheus endpoint with the internal metrics of the server
+func (t *TASServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	p := &promWriter{}
+	t.writeIngestMetrics(p)
+	t.writeTreeMetrics(p)
+	t.writeHTTPMetrics(p)
+	writeRuntimeMetrics(p)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.buf.Bytes())
+}
+
+func (t *TASServer) writeIngestMetrics(p *promWriter) {
+	outcomes := t.stats.verbOutcomes()
+	keys := make([]verbOutcome, 0, len(outcomes))
+	for outcome := range outcomes {
+		keys = append(keys, outcome)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].verb != keys[j].verb {
+			return keys[i].verb < keys[j].verb
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	received := make(map[string]uint64)
+	for _, outcome := range keys {
+		received[outcome.verb] += outcomes[outcome]
+	}
+	p.header("tas_messages_received_total", "counter", "Messages received, by verb.")
+	for _, verb := range sortedKeys(received) {
+		p.sample("tas_messages_received_total", float64(received[verb]), "verb", verb)
+	}
+	p.header("tas_messages_accepted_total", "counter", "Messages added to the tree, by verb.")
+	for _, outcome := range keys {
+		if outcome.reason == "" {
+			p.sample("tas_messages_accepted_total", float64(outcomes[outcome]), "verb", outcome.verb)
+		}
+	}
+	p.header("tas_messages_rejected_total", "counter", "Messages rejected, by verb and reason.")
+	for _, outcome := range keys {
+		if outcome.reason != "" {
+			p.sample("tas_messages_rejected_total", float64(outcomes[outcome]), "verb", outcome.verb, "reason", outcome.reason)
+		}
+	}
+
+	adjusted := t.stats.adjustments()
+	p.header("tas_timestamps_adjusted_total", "counter", "Timestamps filled in or clamped by the server, by kind.")
+	for _, kind := range sortedKeys(adjusted) {
+		p.sample("tas_timestamps_adjusted_total", float64(adjusted[kind]), "kind", kind)
+	}
+
+	p.header("tas_ingest_duration_seconds", "histogram", "Time taken to add a decoded message to the tree.")
+	p.histogram("tas_ingest_duration_seconds", t.metrics.ingestLatency)
+
+	if t.tcp != nil {
+		s := t.tcp.Stats()
+		p.header("tas_tcp_open_connections", "gauge", "Open TCP connections.")
+		p.sample("tas_tcp_open_connections", float64(s.OpenConnections))
+		p.header("tas_tcp_connections_total", "counter", "TCP connections accepted.")
+		p.sample("tas_tcp_connections_total", float64(s.TotalConnections))
+		p.header("tas_tcp_refused_connections_total", "counter", "TCP connections refused over the connection limit.")
+		p.sample("tas_tcp_refused_connections_total", float64(s.RefusedConnections))
+		p.header("tas_tcp_idle_timeouts_total", "counter", "TCP connections closed for being idle.")
+		p.sample("tas_tcp_idle_timeouts_total", float64(s.IdleTimeouts))
+		p.header("tas_tcp_lines_too_long_total", "counter", "TCP connections closed for a line over the limit.")
+		p.sample("tas_tcp_lines_too_long_total", float64(s.LinesTooLong))
+		p.header("tas_tcp_lines_total", "counter", "Lines read over TCP.")
+		p.sample("tas_tcp_lines_total", float64(s.Lines))
+		p.header("tas_tcp_read_bytes_total", "counter", "Bytes read over TCP.")
+		p.sample("tas_tcp_read_bytes_total", float64(s.Bytes))
+	}
+}
+
+func (t *TASServer) writeTreeMetrics(p *promWriter) {
+	t.metrics.mu.Lock()
+	runs, freed := t.metrics.gcRuns, t.metrics.gcFreed
+	t.metrics.mu.Unlock()
+	p.header("tas_gc_runs_total", "counter", "Garbage collector runs.")
+	p.sample("tas_gc_runs_total", float64(runs))
+	p.header("tas_gc_freed_leafs_total", "counter", "Leafs deleted by the garbage collector.")
+	p.sample("tas_gc_freed_leafs_total", float64(freed))
+	p.header("tas_gc_duration_seconds", "histogram", "Duration of the garbage collector runs.")
+	p.histogram("tas_gc_duration_seconds", t.metrics.gcDuration)
+
+	p.header("tas_tree_leafs", "gauge", "Leafs in the tree.")
+	p.sample("tas_tree_leafs", float64(t.pfdTree.GetNumLeafs()))
+	p.header("tas_tree_nodes", "gauge", "Nodes in the data tree, leafs included.")
+	p.sample("tas_tree_nodes", float64(t.pfdTree.GetNumNodes()))
+}
+
+func (t *TASServer) writeHTTPMetrics(p *promWriter) {
+	t.metrics.mu.Lock()
+	requests := make([]httpRequest, 0, len(t.metrics.httpRequests))
+	counts := make(map[httpRequest]uint64, len(t.metrics.httpRequests))
+	for request, n := range t.metrics.httpRequests {
+		requests = append(requests, request)
+		counts[request] = n
+	}
+	endpoints := make([]string, 0, len(t.metrics.httpLatency))
+	latency := make(map[string]*histogram, len(t.metrics.httpLatency))
+	for endpoint, h := range t.metrics.httpLatency {
+		endpoints = append(endpoints, endpoint)
+		latency[endpoint] = h
+	}
+	t.metrics.mu.Unlock()
+	sort.Strings(endpoints)
+
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].endpoint != requests[j].endpoint {
+			return requests[i].endpoint < requests[j].endpoint
+		}
+		return requests[i].code < requests[j].code
+	})
+	p.header("tas_http_requests_total", "counter", "HTTP requests, by endpoint and status code.")
+	for _, request := range requests {
+		p.sample("tas_http_requests_total", float64(counts[request]), "endpoint", request.endpoint, "code", strconv.Itoa(request.code))
+	}
+	p.header("tas_http_request_duration_seconds", "histogram", "Duration of HTTP requests, by endpoint.")
+	for _, endpoint := range endpoints {
+		p.histogram("tas_http_request_duration_seconds", latency[endpoint], "endpoint", endpoint)
+	}
+}
+
+func writeRuntimeMetrics(p *promWriter) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	p.header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	p.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	p.header("go_info", "gauge", "Information about the Go environment.")
+	p.sample("go_info", 1, "version", runtime.Version())
+	p.header("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	p.sample("go_memstats_alloc_bytes", float64(m.Alloc))
+	p.header("go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.")
+	p.sample("go_memstats_alloc_bytes_total", float64(m.TotalAlloc))
+	p.header("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	p.sample("go_memstats_sys_bytes", float64(m.Sys))
+	p.header("go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	p.sample("go_memstats_heap_objects", float64(m.HeapObjects))
+	p.header("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	p.sample("go_memstats_heap_inuse_bytes", float64(m.HeapInuse))
+	p.header("go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.")
+	p.sample("go_memstats_next_gc_bytes", float64(m.NextGC))
+	p.header("go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of last garbage collection.")
+	p.sample("go_memstats_last_gc_time_seconds", float64(m.LastGC)/1e9)
+	p.header("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	p.sample("go_gc_cycles_total", float64(m.NumGC))
+	p.header("go_gc_pause_seconds_total", "counter", "Total time spent in GC stop-the-world pauses.")
+	p.sample("go_gc_pause_seconds_total", float64(m.PauseTotalNs)/1e9)
+}
+
+// Returns the keys of a map of counts in order
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,124 @@
+package tas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// Returned by Reload when the configuration has no ReloadConfig
+var ErrNoReload = errors.New("configuration reloading is not enabled (no ReloadConfig)")
+
+// Outcome of a configuration reload
+type ReloadResult struct {
+	Applied         []string `json:"applied"`          // Settings that changed and are in effect
+	RestartRequired []string `json:"restart_required"` // Settings that changed but keep their value until a restart
+}
+
+// Loads the configuration from ReloadConfig and applies the settings that
+// can change while the server runs, such as the retention, the limits, the
+// Graphite rules and the HTTP credentials. The other settings that changed
+// keep their value until a restart.
+func (t *TASServer) Reload() (result ReloadResult, err error) {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+
+	current := t.conf()
+	if current.ReloadConfig == nil {
+		return result, ErrNoReload
+	}
+	loaded, err := current.ReloadConfig()
+	if err != nil {
+		return result, err
+	}
+	loaded = loaded.withDefaults()
+	if err = loaded.Validate(); err != nil {
+		return result, err
+	}
+
+	// Start from the running configuration, which keeps the settings that
+	// need a restart and the ones that are only set from Go code
+	next := *current
+	result = ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	for i := range settings {
+		s := &settings[i]
+		if sameSetting(s.get(current), s.get(loaded)) {
+			continue
+		}
+		// The level of a Logger passed in the configuration is up to its
+		// handler, so log_level never applies to it
+		if s.live && !(s.name == "log_level" && current.Logger != nil) {
+			s.copy(&next, loaded)
+			result.Applied = append(result.Applied, s.name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, s.name)
+		}
+	}
+	if err = next.Validate(); err != nil {
+		return ReloadResult{}, err
+	}
+
+	t.configMu.Lock()
+	t.config = &next
+	t.configMu.Unlock()
+	if level, err := parseLogLevel(next.LogLevel); err == nil {
+		t.logLevel.Set(level)
+	}
+	if t.tcp != nil {
+		t.tcp.SetLimits(next.TCPMaxLineBytes, next.TCPIdleTimeout, next.TCPMaxConnections, next.TCPAck)
+	}
+	return result, nil
+}
+
+// Compares the values of a setting, treating nil and empty lists alike
+func sameSetting(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() == reflect.Slice && va.Len() == 0 && vb.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Reloads the configuration and logs the outcome
+func (t *TASServer) logReload() {
+	result, err := t.Reload()
+	if err != nil {
+		t.log.Error("Could not reload the configuration", "error", err)
+		return
+	}
+	t.log.Info("Reloaded the configuration", "applied", result.Applied, "restart_required", result.RestartRequired)
+}
+
+// HTTP endpoint that reloads the configuration on a POST and returns the
+// settings that were applied and the ones that need a restart
+func (t *TASServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	result, apiErr := t.reloadRequest(r)
+	if apiErr != nil {
+		writePlainError(w, apiErr)
+		return
+	}
+	returnVal, e := json.Marshal(result)
+	if e != nil {
+		returnVal = []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(returnVal))
+}
+
+// Reloads the configuration for an HTTP request
+func (t *TASServer) reloadRequest(r *http.Request) (ReloadResult, *apiError) {
+	if r.Method != "POST" {
+		return ReloadResult{}, methodNotAllowed("POST")
+	}
+	result, err := t.Reload()
+	if err == ErrNoReload {
+		return result, newAPIError(http.StatusNotImplemented, "not_implemented", "%v", err)
+	}
+	if err != nil {
+		return result, newAPIError(http.StatusInternalServerError, "reload_failed", "Could not reload the configuration: %v", err)
+	}
+	t.log.Info("Reloaded the configuration", "applied", result.Applied, "restart_required", result.RestartRequired)
+	return result, nil
+}
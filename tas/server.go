@@ -1,276 +1,719 @@
 package tas
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 import (
 	"github.com/chango/tas/tree"
-	"github.com/pebbe/zmq3"
 )
 
+// How long Run waits for the server to shut down after a signal
+const shutdownTimeout = 30 * time.Second
+
+// Returned when starting a server that has been shut down
+var ErrServerClosed = errors.New("TAS server is closed")
+
 type TASServer struct {
-	config  *TASConfig
-	pfdTree *tree.Tree
-	socket  *zmq3.Socket
-	closing bool
+	configMu   sync.RWMutex
+	config     *TASConfig // Replaced as a whole by Reload, read it with conf()
+	reloadMu   sync.Mutex
+	pfdTree    *tree.Tree
+	transports []Transport
+	tcp        *TCPTransport
+	closing    atomic.Bool
+	serving    atomic.Int32 // Transports being served
+	stats      *ingestStats
+	metrics    *serverMetrics
+	tlsConfig  *tls.Config
+	handler    http.Handler
+	pages      *template.Template // Templates of the HTML pages
+	static     fs.FS              // Scripts and style sheets of the HTML pages
+	log        *slog.Logger
+	logLevel   slog.LevelVar // Level of the logger built from LogLevel
+	logCloser  io.Closer     // Log file, if any
+	sampler    *logSampler
+
+	mu           sync.Mutex // Guards started and http
+	started      bool
+	http         *http.Server
+	httpListener net.Listener
+	stop         chan struct{}  // Closed when the server starts shutting down
+	wg           sync.WaitGroup // Goroutines of the server
+	stopOnce     sync.Once      // Starts waiting for the goroutines on the first Shutdown
+	stopped      chan struct{}  // Closed once the goroutines exited and the log is closed
+
+	statsd     *statsdParser
+	statsdConn net.PacketConn
+
+	graphiteListener net.Listener
+	graphiteConn     net.PacketConn
+	graphiteMu       sync.Mutex
+	graphiteConns    map[net.Conn]bool
 }
 
 // Returns a new TAS server that is running in the background
 func NewTASServer(config *TASConfig) (t *TASServer, err error) {
+	t, err = New(config)
+	if err != nil {
+		return
+	}
+	err = t.Start(context.Background())
+	return
+}
+
+// Returns a new TAS server with its sockets open, which starts receiving
+// messages once Start is called. Settings left at zero that the server
+// cannot run without take their default value.
+func New(config *TASConfig) (t *TASServer, err error) {
+	config = config.withDefaults()
 	t = &TASServer{
 		config:  config,
 		pfdTree: tree.MakeTree(),
+		stats:   newIngestStats(config.DeadLetterSize),
+		metrics: newServerMetrics(),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		sampler: &logSampler{first: config.LogSampleFirst, thereafter: config.LogSampleThereafter},
+	}
+	if err = config.Validate(); err != nil {
+		return
 	}
-	t.socket, err = zmq3.NewSocket(zmq3.PULL)
+	t.log, t.logCloser, err = newLogger(config, &t.logLevel)
 	if err != nil {
-		err = fmt.Errorf("Could not create ZMQ socket: %v", err)
 		return
 	}
-	zmqAddress := fmt.Sprintf("tcp://%s:%s", t.config.ZMQAddress, t.config.ZMQPort)
-	err = t.socket.Bind(zmqAddress)
+	defer func() {
+		if err != nil && t.logCloser != nil {
+			t.logCloser.Close()
+		}
+	}()
+	if t.tlsConfig, err = loadTLSConfig(t.config.HTTPTLSCertFile, t.config.HTTPTLSKeyFile); err != nil {
+		return
+	}
+	assets, err := loadAssets(t.config.HTTPAssetsDir)
+	if err == nil {
+		t.pages, err = parsePages(assets)
+	}
+	if err == nil {
+		t.static, err = fs.Sub(assets, "static")
+	}
 	if err != nil {
-		err = fmt.Errorf("Could not bind ZMQ socket: %v", err)
+		err = fmt.Errorf("Could not load the HTML pages: %v", err)
 		return
 	}
-	go t.gcAgent()
-	go t.receiver()
-	go t.httpServer()
+	if t.config.ZMQPort != "" {
+		zmqAddress := fmt.Sprintf("tcp://%s:%s", t.config.ZMQAddress, t.config.ZMQPort)
+		var transport Transport
+		transport, err = newZMQTransport(zmqAddress, t.zmqCurve(), t.log)
+		if err != nil {
+			return
+		}
+		t.transports = append(t.transports, transport)
+	}
+	if t.config.ZMQAckPort != "" {
+		zmqAddress := fmt.Sprintf("tcp://%s:%s", t.config.ZMQAddress, t.config.ZMQAckPort)
+		var transport Transport
+		transport, err = newZMQAckTransport(zmqAddress, t.zmqCurve(), t.log)
+		if err != nil {
+			t.close()
+			return
+		}
+		t.transports = append(t.transports, transport)
+	}
+	if t.config.TCPPort != "" {
+		tcpAddress := fmt.Sprintf("%s:%s", t.config.TCPAddress, t.config.TCPPort)
+		t.tcp, err = NewTCPTransport(tcpAddress)
+		if err != nil {
+			err = fmt.Errorf("Could not listen for TCP on %s: %v", tcpAddress, err)
+			t.close()
+			return
+		}
+		t.tcp.MaxLineBytes = t.config.TCPMaxLineBytes
+		t.tcp.IdleTimeout = t.config.TCPIdleTimeout
+		t.tcp.MaxConnections = t.config.TCPMaxConnections
+		t.tcp.Ack = t.config.TCPAck
+		t.tcp.Logger = t.log
+		t.transports = append(t.transports, t.tcp)
+	}
+	t.transports = append(t.transports, t.config.Transports...)
+	if t.config.StatsDPort != "" {
+		if err = t.listenStatsd(); err != nil {
+			t.close()
+			return
+		}
+	}
+	if t.config.GraphitePort != "" {
+		if err = t.listenGraphite(); err != nil {
+			t.close()
+			return
+		}
+	}
+	if t.config.HTTPPort != "" {
+		httpAddr := fmt.Sprintf("%s:%s", t.config.HTTPAddress, t.config.HTTPPort)
+		t.httpListener, err = net.Listen("tcp", httpAddr)
+		if err != nil {
+			err = fmt.Errorf("Could not listen for HTTP on %s: %v", httpAddr, err)
+			t.close()
+			return
+		}
+	}
+	t.handler = t.newHandler()
 	return
 }
 
-// Blocking runner that traps SIGINT and SIGTERM to gracefully shutdown
-// the TAS server.
-func (t *TASServer) Run() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+// Starts receiving messages, collecting garbage and serving the HTTP pages
+// in the background. The server shuts down when ctx is done.
+func (t *TASServer) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing.Load() {
+		return ErrServerClosed
+	}
+	if t.started {
+		return errors.New("TAS server is already started")
+	}
+	t.started = true
+
+	if t.statsdConn != nil {
+		t.spawn(t.statsdReceiver)
+	}
+	if t.graphiteListener != nil {
+		t.spawn(t.graphiteAcceptor)
+		t.spawn(t.graphitePacketReceiver)
+	}
+	t.spawn(t.gcAgent)
+	for _, transport := range t.transports {
+		transport := transport
+		t.spawn(func() { t.serveTransport(transport) })
+	}
+	if t.httpListener != nil {
+		t.http = &http.Server{Handler: t.handler, TLSConfig: t.tlsConfig}
+		t.spawn(t.httpServer)
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				if err := t.Shutdown(shutdownCtx); err != nil {
+					t.log.Error("Shutdown error", "error", err)
+				}
+			case <-t.stop:
+			}
+		}()
+	}
+	return nil
+}
+
+// Stops receiving messages, waits for the messages being processed and
+// the HTTP requests in flight, and waits for all the goroutines of the
+// server to exit. Returns ctx's error if ctx is done before then, in which
+// case the log file stays open until the goroutines exit.
+func (t *TASServer) Shutdown(ctx context.Context) error {
+	var errs []error
+	if err := t.closeDrain(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	t.mu.Lock()
+	server := t.http
+	t.mu.Unlock()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("HTTP server: %v", err))
+		}
+	}
+
+	t.stopOnce.Do(func() {
+		go func() {
+			t.wg.Wait()
+			t.log.Info("Server stopped")
+			// The log file is only closed now, so that the goroutines still
+			// running when ctx is done can keep logging
+			if t.logCloser != nil {
+				t.logCloser.Close()
+			}
+			close(t.stopped)
+		}()
+	})
 	select {
-	case <-c:
-		tasLog.Info("[tas] Stopping server")
-		t.close()
-		break
+	case <-t.stopped:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
 	}
-	tasLog.Info("[tas] Server stopped")
+	return errors.Join(errs...)
 }
 
-// ZMQ Receiver
-func (t *TASServer) receiver() {
-	var rawMessage string
-	var err error
+// Runs f in a goroutine that Shutdown waits for
+func (t *TASServer) spawn(f func()) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+}
+
+// Returns the current configuration
+func (t *TASServer) conf() *TASConfig {
+	t.configMu.RLock()
+	defer t.configMu.RUnlock()
+	return t.config
+}
+
+// Returns the CURVE security settings for the ZMQ sockets
+func (t *TASServer) zmqCurve() zmqCurve {
+	return zmqCurve{
+		secretKey:  t.config.ZMQCurveSecretKey,
+		clientKeys: t.config.ZMQCurveClientKeys,
+	}
+}
 
-	tasLog.Info("[tas] Starting receiver")
+// Blocking runner that traps SIGINT and SIGTERM to gracefully shutdown
+// the TAS server, and SIGHUP to reload its configuration. Also returns
+// when the server is shut down otherwise.
+func (t *TASServer) Run() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+wait:
 	for {
-		// incoming message format:
-		// INCR/APPEND TS KEY VALUE
-		if t.closing {
-			return
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				t.logReload()
+				continue
+			}
+			t.log.Info("Stopping server", "signal", sig.String())
+			break wait
+		case <-t.stop:
+			break wait
 		}
-		rawMessage, err = t.socket.Recv(0)
-		tasLog.Debug(rawMessage)
-		if err != nil {
-			tasLog.Info("[tas] ZMQ receive error ", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := t.Shutdown(ctx); err != nil {
+		t.log.Error("Shutdown error", "error", err)
+	}
+}
+
+// Processes every line of a newline separated batch, or every message of
+// a binary frame, independently and returns the outcome of each message
+func (t *TASServer) processBatch(batch []byte) []IngestResult {
+	if IsBinary(batch) {
+		return t.processBinary(batch)
+	}
+
+	lines := strings.Split(string(batch), "\n")
+	results := make([]IngestResult, 0, len(lines))
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
 			continue
 		}
-		t.process(rawMessage)
+		results = append(results, newIngestResult(i+1, t.process(line)))
+	}
+	return results
+}
+
+// Processes the messages of a binary frame. A frame that cannot be
+// decoded is rejected as a single malformed message after the messages
+// that came before the error.
+func (t *TASServer) processBinary(frame []byte) []IngestResult {
+	messages, err := DecodeBinary(frame)
+	results := make([]IngestResult, 0, len(messages)+1)
+	for i, m := range messages {
+		results = append(results, newIngestResult(i+1, t.processMessage(m)))
+	}
+	if err != nil {
+		ingestErr := reject(ReasonMalformed, "invalid binary frame: %v", err)
+		t.stats.record("", quoteFrame(frame), ingestErr)
+		results = append(results, newIngestResult(len(messages)+1, ingestErr))
 	}
+	return results
 }
 
-func (t *TASServer) process(rawMessage string) {
-	var data interface{}
+// Processes a single raw message and records whether it was accepted
+func (t *TASServer) process(rawMessage string) *IngestError {
+	m, err := decodeLine(rawMessage)
+	if err == nil {
+		err = t.ingest(m)
+	}
+	if err != nil {
+		t.logMessage("Rejected message", "message", rawMessage, "reason", err.Reason, "error", err.Err)
+	}
+	t.stats.record(m.Verb, rawMessage, err)
+	return err
+}
+
+// Processes a decoded message and records whether it was accepted
+func (t *TASServer) processMessage(m Message) *IngestError {
+	err := t.ingest(m)
+	rawMessage := ""
+	if err != nil {
+		rawMessage = m.String()
+		t.logMessage("Rejected message", "message", rawMessage, "reason", err.Reason, "error", err.Err)
+	}
+	t.stats.record(m.Verb, rawMessage, err)
+	return err
+}
+
+// Decodes a message in the text protocol:
+// INCR/APPEND/GAUGE TS KEY VALUE
+func decodeLine(rawMessage string) (m Message, ingestErr *IngestError) {
+	message := strings.SplitN(rawMessage, " ", 4)
+	if len(message) != 4 {
+		return m, reject(ReasonMalformed, "expected 4 fields, got %d", len(message))
+	}
+	m = Message{Verb: message[0], Timestamp: message[1], Key: message[2]}
+
+	switch m.Verb {
+	case "INCR":
+		v, e := strconv.Atoi(message[3])
+		if e != nil {
+			return m, reject(ReasonBadValue, "INCR value is not an integer: %q", message[3])
+		}
+		m.Value = v
+	case "APPEND":
+		var data interface{}
+		if e := json.Unmarshal([]byte(message[3]), &data); e != nil {
+			return m, reject(ReasonBadValue, "APPEND value is not valid JSON: %v", e)
+		}
+		m.Value = data
+	case "GAUGE":
+		v, e := strconv.ParseFloat(message[3], 64)
+		if e != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return m, reject(ReasonBadValue, "GAUGE value is not a number: %q", message[3])
+		}
+		m.Value = v
+	default:
+		return m, reject(ReasonBadVerb, "unknown verb %q", m.Verb)
+	}
+	return m, nil
+}
+
+// Adds a decoded message to the tree
+func (t *TASServer) ingest(m Message) (ingestErr *IngestError) {
+	start := time.Now()
 	defer func() {
+		t.metrics.ingestLatency.observe(time.Since(start).Seconds())
 		if r := recover(); r != nil {
-			tasLog.Info("TAS Panic", rawMessage, r)
+			t.log.Error("Panic while ingesting a message", "message", m.String(), "panic", fmt.Sprint(r))
+			ingestErr = reject(ReasonPanic, "%v", r)
 		}
 	}()
 
-	message := strings.SplitN(rawMessage, " ", 4)
-	if message[0] == "INCR" {
-		value, e := strconv.Atoi(message[3])
-		if e == nil {
-			t.pfdTree.AddData(message[2], value, message[1])
+	switch m.Verb {
+	case "INCR":
+		if _, ok := m.Value.(int); !ok {
+			return reject(ReasonBadValue, "INCR value is not an integer")
+		}
+	case "APPEND":
+		if _, ok := m.Value.([]interface{}); !ok {
+			return reject(ReasonBadValue, "APPEND value is not a JSON array")
 		}
-	} else if message[0] == "APPEND" {
-		e := json.Unmarshal([]byte(message[3]), &data)
-		if e == nil {
-			t.pfdTree.AddData(message[2], data, message[1])
+	case "GAUGE":
+		switch m.Value.(type) {
+		case float64, tree.GaugeDelta:
+		default:
+			return reject(ReasonBadValue, "GAUGE value is not a number")
 		}
+	default:
+		return reject(ReasonBadVerb, "unknown verb %q", m.Verb)
+	}
+
+	var ts int64
+	var adjustment string
+	if m.Timestamp == "" {
+		ts, adjustment, ingestErr = t.acceptTimestamp(m.UnixNano)
+	} else {
+		ts, adjustment, ingestErr = t.resolveTimestamp(m.Timestamp)
+	}
+	if ingestErr != nil {
+		return ingestErr
 	}
 
+	value := m.Value
+	if g, ok := value.(float64); ok {
+		value = tree.Gauge(g)
+	}
+	if e := t.pfdTree.AddDataAt(m.Key, value, ts); e != nil {
+		return reject(ReasonTypeConflict, "%s %s: %v", m.Verb, m.Key, e)
+	}
+	if adjustment != "" {
+		t.stats.adjust(adjustment)
+	}
+	return nil
 }
 
-// Agent that runs a GC on all the child nodes every 4 seconds
+// Agent that runs a GC on all the child nodes every GCInterval
 func (t *TASServer) gcAgent() {
-	log.Println("[tas] Starting gcAgent")
-	roundToNearest := 5
+	t.log.Info("Starting gcAgent")
 	for {
-		if t.closing {
+		c := t.conf()
+		start := time.Now()
+		freed := t.pfdTree.GCBefore(start.Add(-c.Retention).UnixNano())
+		t.metrics.gc(time.Since(start), freed)
+		timer := time.NewTimer(c.GCInterval)
+		select {
+		case <-timer.C:
+		case <-t.stop:
+			timer.Stop()
 			return
 		}
-		currentTime := time.Now().Unix()
-		gcTime := roundToNearest*int(currentTime/int64(roundToNearest)) - 60
-		gcTimeStr := strconv.Itoa(gcTime)
-		if gcTime%8 == 0 {
-			for _, c := range *t.pfdTree.Timestamps() {
-				if c.Key < gcTimeStr {
-					t.pfdTree.DoGC(c.Key)
-				}
-			}
-		} else {
-			t.pfdTree.DoGC(gcTimeStr)
-		}
-		time.Sleep(4 * time.Second)
 	}
 }
 
-// The HTTP server
-func (t *TASServer) httpServer() {
-	var err error
-	http.HandleFunc("/GET", func(w http.ResponseWriter, r *http.Request) {
+// Returns the handler of the HTTP pages, for mounting TAS into another
+// HTTP server. The pages are served under HTTPPrefix.
+func (t *TASServer) Handler() http.Handler {
+	return t.handler
+}
+
+// Returns the path prefix the HTTP pages are served under, without a
+// trailing slash
+func httpPrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// Builds the HTTP pages on a mux of their own
+func (t *TASServer) newHandler() http.Handler {
+	mux := http.NewServeMux()
+	prefix := httpPrefix(t.config.HTTPPrefix)
+	mux.HandleFunc(prefix+"/GET", t.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
 		var tsList []string
 		if r.FormValue("t") != "" {
 			tsList = strings.Split(r.FormValue("t"), ",")
+			for i, ts := range tsList {
+				tsList[i] = t.bucketKey(ts)
+			}
 		}
 		var intervalSeconds float64 = 5.0
 		if r.FormValue("i") != "" {
 			intervalSeconds, _ = strconv.ParseFloat(r.FormValue("i"), 32)
 		}
-		val := t.pfdTree.GetValue(strings.Split(r.FormValue("key"), "."), tsList, intervalSeconds)
+		format, apiErr := queryFormat(r, false)
+		buckets := false
+		if apiErr == nil {
+			buckets, apiErr = queryBuckets(r)
+		}
+		if apiErr != nil {
+			writePlainError(w, apiErr)
+			return
+		}
+		key := strings.Split(r.FormValue("key"), ".")
+		if format != formatJSON {
+			writeRows(w, format, t.pfdTree.GetRows(key, tsList, intervalSeconds, buckets))
+			return
+		}
+		var val interface{}
+		if buckets {
+			val = newJSONRows(t.pfdTree.GetRows(key, tsList, intervalSeconds, true))
+		} else {
+			val = t.pfdTree.GetValue(key, tsList, intervalSeconds)
+		}
 		returnVal, e := json.Marshal(val)
 		if e != nil {
 			returnVal = []byte("{}")
 		}
 		fmt.Fprint(w, string(returnVal))
-	})
+	}))
 
-	http.HandleFunc("/DIAG", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(prefix+"/DIAG", t.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
 		// Function called to get diagnostics
-
-		//Create a map of all the diagnostics
-		mapVal := map[string]interface{}{
-			"oldest_timestamp": t.pfdTree.GetOldestTS(),
-			"current_time":     time.Now().Unix(),
-			"gc_running":       t.pfdTree.CheckGCRunning(),
-			"num_leafs":        t.pfdTree.GetNumLeafs(),
-			"ts_counts":        TSCounters(t.pfdTree.Timestamps()),
-		}
-		returnVal, e := json.Marshal(mapVal)
+		returnVal, e := json.Marshal(t.diagnostics())
 		if e != nil {
 			returnVal = []byte("{}")
 		}
 		fmt.Fprint(w, string(returnVal))
-	})
+	}))
 
-	http.HandleFunc("/TREE", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(prefix+"/DEADLETTER", t.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		// Function called to inspect the most recently rejected messages
+		returnVal, e := json.Marshal(t.deadLetterReport())
+		if e != nil {
+			returnVal = []byte("{}")
+		}
+		fmt.Fprint(w, string(returnVal))
+	}))
 
-		//Create a new template
-		templ := template.New("Tree Structure")
-		// define a child template which will hold the actual tree
-		Tree := templ.New("Tree")
+	t.registerAPI(mux, prefix)
 
-		//Parse the tree data to create a html version of the tree
-		Tree, err = Tree.Parse(TreePrinter(t.pfdTree.DataNode))
+	mux.HandleFunc(prefix+"/INGEST", t.authorize(ScopeAdmin, t.handleIngest))
 
-		// Throw out error if any issue
-		if err != nil {
-			fmt.Fprint(w, err)
-			return
-		}
+	mux.HandleFunc(prefix+"/RELOAD", t.authorize(ScopeAdmin, t.handleReload))
 
-		//Parse files
-		templ, err = templ.ParseFiles("html/tree-d3.html")
+	mux.HandleFunc(prefix+"/healthz", t.handleHealthz)
+	mux.HandleFunc(prefix+"/readyz", t.handleReadyz)
+	mux.HandleFunc(prefix+"/metrics", t.authorize(ScopeRead, t.handleMetrics))
 
-		//Throw out error
-		if err != nil {
-			fmt.Fprint(w, fmt.Sprintf("Error parsing file: %v", err))
-			return
-		}
+	mux.HandleFunc(prefix+"/EXPORT", t.authorize(ScopeRead, t.handleExport))
 
-		//Execute the template and write it out
-		err = templ.ExecuteTemplate(w, "tree-d3.html", t.pfdTree.DataNode)
+	mux.Handle(prefix+"/static/", t.authorize(ScopeRead, http.StripPrefix(prefix+"/static/", http.FileServer(http.FS(t.static))).ServeHTTP))
 
-		//Throw out error
-		if err != nil {
-			fmt.Fprint(w, err)
-			return
-		}
-	})
+	mux.HandleFunc(prefix+"/TREE", t.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		t.renderPage(w, "tree-d3.html", t.treeData())
+	}))
 
-	http.HandleFunc("/STATS", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(prefix+"/STATS", t.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		t.renderPage(w, "ts-stats-d3.html", t.timestampCounts())
+	}))
 
-		ts_counts := TSCounters(t.pfdTree.Timestamps())
+	mux.HandleFunc(prefix+"/", t.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		t.renderPage(w, "main.html", nil)
+	}))
 
-		// Create a new template
-		templ := template.New("Timestamp Counts")
-		// Define a child template which holds the timestamp counts
-		Timestamps := templ.New("TS_COUNTS")
+	return t.instrument(mux, prefix)
+}
 
-		// Parse the timestamp counts data to create a html version of the bar chart
-		Timestamps, err = Timestamps.Parse(ts_counts)
+// The HTTP server
+func (t *TASServer) httpServer() {
+	var err error
+	if t.tlsConfig != nil {
+		t.log.Info("HTTPS listening", "addr", t.httpListener.Addr().String())
+		err = t.http.ServeTLS(t.httpListener, "", "")
+	} else {
+		t.log.Info("HTTP listening", "addr", t.httpListener.Addr().String())
+		err = t.http.Serve(t.httpListener)
+	}
+	if err != http.ErrServerClosed {
+		t.log.Error("HTTP server stopped", "error", err)
+	}
+}
 
-		// Throw out error if any issue
-		if err != nil {
-			fmt.Fprint(w, err)
-			return
-		}
+// Returns whether the GC deletes data on time
+func (t *TASServer) gcRunning() bool {
+	c := t.conf()
+	return t.pfdTree.CheckGCRunningFor(c.Retention + c.GCInterval + time.Second)
+}
 
-		//Parse files
-		templ, err = templ.ParseFiles("html/ts-stats-d3.html")
+// Renders the page template name with data, which the template escapes
+// for the context it is used in
+func (t *TASServer) renderPage(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	err := t.pages.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error rendering %s: %v", name, err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
 
-		//Throw out error
-		if err != nil {
-			fmt.Fprint(w, fmt.Sprintf("Error parsing file: %v", err))
-			return
-		}
+// Returns a map of all the diagnostics
+func (t *TASServer) diagnostics() map[string]interface{} {
+	mapVal := map[string]interface{}{
+		"oldest_timestamp": t.pfdTree.GetOldestTS(),
+		"current_time":     time.Now().Unix(),
+		"gc_running":       t.gcRunning(),
+		"num_leafs":        t.pfdTree.GetNumLeafs(),
+		"ts_counts":        t.tsCounts(),
+	}
+	received, accepted, rejected := t.stats.counts()
+	mapVal["messages_received"] = received
+	mapVal["messages_accepted"] = accepted
+	mapVal["messages_rejected"] = rejected
+	mapVal["timestamps_adjusted"] = t.stats.adjustments()
+	if t.tcp != nil {
+		mapVal["tcp"] = t.tcp.Stats()
+	}
+	return mapVal
+}
 
-		//Execute the template and write it out
-		err = templ.ExecuteTemplate(w, "ts-stats-d3.html", ts_counts)
+// Returns the rejection counts and the most recently rejected messages
+func (t *TASServer) deadLetterReport() map[string]interface{} {
+	_, _, rejected := t.stats.counts()
+	return map[string]interface{}{
+		"rejected": rejected,
+		"messages": t.stats.deadLetters(),
+	}
+}
 
-		//Throw out error
-		if err != nil {
-			fmt.Fprint(w, err)
-			return
-		}
-	})
+// Returns the timestamp counts while holding the tree's read lock
+func (t *TASServer) tsCounts() string {
+	t.pfdTree.RLock()
+	defer t.pfdTree.RUnlock()
+	return TSCounters(t.pfdTree.Timestamps())
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		templ := template.New("Main")
-		templ, err := templ.ParseFiles("html/main.html")
+// Returns the timestamp counts for the STATS page while holding the tree's
+// read lock
+func (t *TASServer) timestampCounts() []tsCount {
+	t.pfdTree.RLock()
+	defer t.pfdTree.RUnlock()
+	return countTimestamps(t.pfdTree.Timestamps())
+}
 
-		//Throw out error
-		if err != nil {
-			fmt.Fprint(w, fmt.Sprintf("Error parsing file: %v", err))
-			return
-		}
+// Returns the tree data for the TREE page while holding the tree's read lock
+func (t *TASServer) treeData() *treeNode {
+	t.pfdTree.RLock()
+	defer t.pfdTree.RUnlock()
+	return newTreeNode(t.pfdTree.DataNode)
+}
 
-		err = templ.ExecuteTemplate(w, "main.html", nil)
+// Stops receiving messages and wakes up the agents of the server. Only the
+// first call closes anything.
+func (t *TASServer) close() error {
+	return t.closeDrain(context.Background())
+}
 
-		//Throw out error
+// Closes the server like close, but lets the transports that support it
+// hand over the messages they already received until ctx is done
+func (t *TASServer) closeDrain(ctx context.Context) error {
+	if !t.closing.CompareAndSwap(false, true) {
+		return nil
+	}
+	t.log.Info("Closing server connections")
+	close(t.stop)
+	var errs []error
+	for _, transport := range t.transports {
+		var err error
+		if d, ok := transport.(drainingTransport); ok {
+			err = d.closeDrain(ctx)
+		} else {
+			err = transport.Close()
+		}
 		if err != nil {
-			fmt.Fprint(w, fmt.Sprintf("Error parsing ex file: %v", err))
-			return
+			errs = append(errs, err)
 		}
-	})
-
-	httpAddr := fmt.Sprintf("%s:%s", t.config.HTTPAddress, t.config.HTTPPort)
-	log.Printf("[tas] HTTP listening on %s...", httpAddr)
-	log.Fatal(http.ListenAndServe(httpAddr, nil))
-}
-
-// Gracefully close TAS and its subsequent connections
-func (t *TASServer) close() {
-	log.Println("[tas] Closing server connections")
-	if !t.closing {
-		t.closing = true
-		t.socket.Close()
 	}
+	if t.statsdConn != nil {
+		t.statsdConn.Close()
+	}
+	if t.graphiteListener != nil {
+		t.closeGraphite()
+	}
+	t.mu.Lock()
+	if t.http == nil && t.httpListener != nil {
+		// The HTTP server never started, so Shutdown won't close its listener
+		t.httpListener.Close()
+	}
+	t.mu.Unlock()
+	return errors.Join(errs...)
 }
@@ -0,0 +1,341 @@
+package tas
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variable holding the path of the configuration file, which
+// the -config flag overrides
+const configEnv = "TAS_CONFIG"
+
+// Prefix of the environment variables that set the configuration
+const envPrefix = "TAS_"
+
+// A configuration setting that can be given in a configuration file, an
+// environment variable and a command line flag. The name is used as is in
+// the file, upper cased with the TAS_ prefix in the environment, and with
+// dashes instead of underscores as a flag.
+type setting struct {
+	name      string
+	fieldName string // Name of the TASConfig field, ie/ "HTTPPort"
+	usage     string
+	live      bool                           // Whether a reload applies it without a restart
+	field     func(c *TASConfig) interface{} // Pointer to the field of the setting in c
+}
+
+// Sets the setting from its string form
+func (s *setting) set(c *TASConfig, value string) error {
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*field = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 90s or 5m", value)
+		}
+		*field = d
+	case *[]string:
+		*field = splitList(value)
+	case *[]HTTPCredential:
+		var credentials []HTTPCredential
+		if err := json.Unmarshal([]byte(value), &credentials); err != nil {
+			return fmt.Errorf("not a JSON array of credentials: %v", err)
+		}
+		*field = credentials
+	case *[]GraphiteRule:
+		var rules []GraphiteRule
+		for _, rule := range splitList(value) {
+			i := strings.LastIndex(rule, "=")
+			if i < 0 {
+				return fmt.Errorf("rule %q is not prefix=mode", rule)
+			}
+			rules = append(rules, GraphiteRule{Prefix: rule[:i], Mode: rule[i+1:]})
+		}
+		*field = rules
+	case *[]ExportRule:
+		var rules []ExportRule
+		for _, rule := range splitList(value) {
+			i := strings.LastIndex(rule, "=")
+			if i < 0 {
+				return fmt.Errorf("rule %q is not pattern=name", rule)
+			}
+			rules = append(rules, ExportRule{Pattern: rule[:i], Name: rule[i+1:]})
+		}
+		*field = rules
+	default:
+		panic("unsupported setting type " + s.name)
+	}
+	return nil
+}
+
+// Returns the value of the setting in c
+func (s *setting) get(c *TASConfig) interface{} {
+	return reflect.ValueOf(s.field(c)).Elem().Interface()
+}
+
+// Copies the value of the setting from src to dst
+func (s *setting) copy(dst, src *TASConfig) {
+	reflect.ValueOf(s.field(dst)).Elem().Set(reflect.ValueOf(s.field(src)).Elem())
+}
+
+// Splits a comma separated list, ignoring empty elements
+func splitList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Every setting of TASConfig that can be configured outside of Go code
+var settings = []setting{
+	{"zmq_port", "ZMQPort", "port to listen for ZMQ traffic on (empty to disable)", false, func(c *TASConfig) interface{} { return &c.ZMQPort }},
+	{"zmq_address", "ZMQAddress", "address to listen for ZMQ traffic on", false, func(c *TASConfig) interface{} { return &c.ZMQAddress }},
+	{"zmq_ack_port", "ZMQAckPort", "port to listen for acknowledged ZMQ traffic on (empty to disable)", false, func(c *TASConfig) interface{} { return &c.ZMQAckPort }},
+	{"zmq_curve_secret_key", "ZMQCurveSecretKey", "Z85 encoded server secret key, enables CURVE security", false, func(c *TASConfig) interface{} { return &c.ZMQCurveSecretKey }},
+	{"zmq_curve_client_keys", "ZMQCurveClientKeys", "comma separated public keys of the allowed ZMQ clients", false, func(c *TASConfig) interface{} { return &c.ZMQCurveClientKeys }},
+
+	{"http_port", "HTTPPort", "port of the HTTP server (empty to disable)", false, func(c *TASConfig) interface{} { return &c.HTTPPort }},
+	{"http_address", "HTTPAddress", "address of the HTTP server", false, func(c *TASConfig) interface{} { return &c.HTTPAddress }},
+	{"http_prefix", "HTTPPrefix", "path prefix of the HTTP pages", false, func(c *TASConfig) interface{} { return &c.HTTPPrefix }},
+	{"http_assets_dir", "HTTPAssetsDir", "directory with templates and static files that replace the embedded ones", false, func(c *TASConfig) interface{} { return &c.HTTPAssetsDir }},
+	{"http_tls_cert_file", "HTTPTLSCertFile", "PEM certificate file, enables HTTPS", false, func(c *TASConfig) interface{} { return &c.HTTPTLSCertFile }},
+	{"http_tls_key_file", "HTTPTLSKeyFile", "PEM private key file of the certificate", false, func(c *TASConfig) interface{} { return &c.HTTPTLSKeyFile }},
+	{"http_credentials", "HTTPCredentials", `JSON array of HTTP credentials, ie/ [{"token": "...", "scope": "read"}]`, true, func(c *TASConfig) interface{} { return &c.HTTPCredentials }},
+	{"http_ingest_max_bytes", "HTTPIngestMaxBytes", "largest request body accepted by /INGEST", true, func(c *TASConfig) interface{} { return &c.HTTPIngestMaxBytes }},
+
+	{"tcp_port", "TCPPort", "port to listen for messages over TCP on (empty to disable)", false, func(c *TASConfig) interface{} { return &c.TCPPort }},
+	{"tcp_address", "TCPAddress", "address to listen for messages over TCP on", false, func(c *TASConfig) interface{} { return &c.TCPAddress }},
+	{"tcp_max_line_bytes", "TCPMaxLineBytes", "longest line accepted over TCP", true, func(c *TASConfig) interface{} { return &c.TCPMaxLineBytes }},
+	{"tcp_idle_timeout", "TCPIdleTimeout", "close TCP connections idle for this long (0 to disable)", true, func(c *TASConfig) interface{} { return &c.TCPIdleTimeout }},
+	{"tcp_max_connections", "TCPMaxConnections", "number of concurrent TCP connections allowed (0 for no limit)", true, func(c *TASConfig) interface{} { return &c.TCPMaxConnections }},
+	{"tcp_ack", "TCPAck", "reply to every TCP line with OK or ERR", true, func(c *TASConfig) interface{} { return &c.TCPAck }},
+
+	{"dead_letter_size", "DeadLetterSize", "number of rejected messages kept for /DEADLETTER", false, func(c *TASConfig) interface{} { return &c.DeadLetterSize }},
+	{"max_past_skew", "MaxPastSkew", "how far in the past a timestamp may be (0 to disable)", true, func(c *TASConfig) interface{} { return &c.MaxPastSkew }},
+	{"max_future_skew", "MaxFutureSkew", "how far in the future a timestamp may be (0 to disable)", true, func(c *TASConfig) interface{} { return &c.MaxFutureSkew }},
+	{"skew_policy", "SkewPolicy", "reject or clamp timestamps outside the skew window", true, func(c *TASConfig) interface{} { return &c.SkewPolicy }},
+	{"bucket_width", "BucketWidth", "width of the time buckets data is grouped in", false, func(c *TASConfig) interface{} { return &c.BucketWidth }},
+	{"retention", "Retention", "how long data is kept", true, func(c *TASConfig) interface{} { return &c.Retention }},
+	{"gc_interval", "GCInterval", "how often the garbage collector runs", true, func(c *TASConfig) interface{} { return &c.GCInterval }},
+
+	{"statsd_port", "StatsDPort", "UDP port to listen for StatsD traffic on (empty to disable)", false, func(c *TASConfig) interface{} { return &c.StatsDPort }},
+	{"statsd_address", "StatsDAddress", "UDP address to listen for StatsD traffic on", false, func(c *TASConfig) interface{} { return &c.StatsDAddress }},
+	{"statsd_prefix", "StatsDPrefix", "prefix added to the keys of StatsD metrics", false, func(c *TASConfig) interface{} { return &c.StatsDPrefix }},
+
+	{"graphite_port", "GraphitePort", "port to listen for Graphite traffic on (empty to disable)", false, func(c *TASConfig) interface{} { return &c.GraphitePort }},
+	{"graphite_address", "GraphiteAddress", "address to listen for Graphite traffic on", false, func(c *TASConfig) interface{} { return &c.GraphiteAddress }},
+	{"graphite_default_mode", "GraphiteDefaultMode", "sum or gauge for Graphite paths without a rule", true, func(c *TASConfig) interface{} { return &c.GraphiteDefaultMode }},
+	{"graphite_rules", "GraphiteRules", "comma separated prefix=mode rules for Graphite paths", true, func(c *TASConfig) interface{} { return &c.GraphiteRules }},
+
+	{"export_rules", "ExportRules", "comma separated pattern=name rules for the keys exported by /EXPORT", true, func(c *TASConfig) interface{} { return &c.ExportRules }},
+	{"memory_budget", "MemoryBudget", "heap bytes in use above which /readyz reports not ready (0 for no budget)", true, func(c *TASConfig) interface{} { return &c.MemoryBudget }},
+
+	{"log_level", "LogLevel", "debug, info, warn or error", true, func(c *TASConfig) interface{} { return &c.LogLevel }},
+	{"log_format", "LogFormat", "logfmt or json", false, func(c *TASConfig) interface{} { return &c.LogFormat }},
+	{"log_output", "LogOutput", "stderr, stdout or a file to append the log to", false, func(c *TASConfig) interface{} { return &c.LogOutput }},
+	{"log_sample_first", "LogSampleFirst", "records about individual messages logged every second before sampling", false, func(c *TASConfig) interface{} { return &c.LogSampleFirst }},
+	{"log_sample_thereafter", "LogSampleThereafter", "log one in this many of the further records about individual messages", false, func(c *TASConfig) interface{} { return &c.LogSampleThereafter }},
+}
+
+func findSetting(name string) *setting {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// Returns the configuration of a server started from the command line.
+// Settings are taken from, in increasing order of precedence, the
+// defaults, the JSON file named by the -config flag or the TAS_CONFIG
+// environment variable, TAS_* environment variables such as TAS_HTTP_PORT,
+// and flags such as -http-port. environ is in the form of os.Environ.
+// Errors name the setting and where its value came from. Returns
+// flag.ErrHelp when the arguments ask for help.
+func LoadTASConfig(name string, args []string, environ []string) (*TASConfig, error) {
+	type flagValue struct {
+		setting *setting
+		value   string
+	}
+	var flagValues []flagValue
+	path := ""
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&path, "config", "", "JSON configuration `file` (or "+configEnv+")")
+	for i := range settings {
+		s := &settings[i]
+		flagName := strings.Replace(s.name, "_", "-", -1)
+		usage := fmt.Sprintf("%s (or %s%s)", s.usage, envPrefix, strings.ToUpper(s.name))
+		flags.Func(flagName, usage, func(value string) error {
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv[:i], envPrefix) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if path == "" {
+		path = env[configEnv]
+	}
+
+	c := NewDefaultTASConfig()
+	// Where the value of each setting given came from, by setting name
+	sources := make(map[string]string)
+	if path != "" {
+		if err := c.loadFile(path, sources); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the environment in a fixed order so that errors are stable
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == configEnv {
+			continue
+		}
+		s := findSetting(strings.ToLower(strings.TrimPrefix(name, envPrefix)))
+		if s == nil {
+			return nil, fmt.Errorf("unknown setting in environment variable %s", name)
+		}
+		if err := s.set(c, env[name]); err != nil {
+			return nil, fmt.Errorf("environment variable %s: %v", name, err)
+		}
+		sources[s.name] = "environment variable " + name
+	}
+
+	for _, f := range flagValues {
+		flagName := "-" + strings.Replace(f.setting.name, "_", "-", -1)
+		if err := f.setting.set(c, f.value); err != nil {
+			return nil, fmt.Errorf("flag %s: %v", flagName, err)
+		}
+		sources[f.setting.name] = "flag " + flagName
+	}
+
+	if err := c.Validate(); err != nil {
+		var e *SettingError
+		if !errors.As(err, &e) {
+			return nil, err
+		}
+		for _, s := range settings {
+			if s.fieldName == e.Field {
+				source, ok := sources[s.name]
+				if !ok {
+					source = "default"
+				}
+				return nil, fmt.Errorf("%s (%s): %s", s.name, source, e.Reason)
+			}
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Applies the settings of a JSON configuration file, an object with the
+// setting names as keys. Values may be strings or JSON values of the
+// setting's type, ie/ "tcp_max_connections": 100 or "graphite_rules":
+// ["servers=gauge"]. The names of the settings applied are added to
+// sources.
+func (c *TASConfig) loadFile(path string, sources map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file: %v", err)
+	}
+	var values map[string]json.RawMessage
+	if err = json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("configuration file %s is not a JSON object: %v", path, err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := findSetting(name)
+		if s == nil {
+			return fmt.Errorf("configuration file %s: unknown setting %q", path, name)
+		}
+		value, err := settingValue(name, values[name])
+		if err == nil {
+			err = s.set(c, value)
+		}
+		if err != nil {
+			return fmt.Errorf("configuration file %s: %s: %v", path, name, err)
+		}
+		sources[name] = "configuration file " + path
+	}
+	return nil
+}
+
+// Returns the string form of a JSON value from a configuration file
+func settingValue(name string, raw json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return string(raw), nil
+	case []interface{}:
+		if name == "http_credentials" {
+			return string(raw), nil
+		}
+		list := make([]string, len(v))
+		for i, element := range v {
+			s, ok := element.(string)
+			if !ok {
+				return "", errors.New("expected an array of strings")
+			}
+			list[i] = s
+		}
+		return strings.Join(list, ","), nil
+	}
+	return "", fmt.Errorf("unexpected value %s", raw)
+}
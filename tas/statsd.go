@@ -0,0 +1,141 @@
+package tas
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/chango/tas/tree"
+)
+
+// Largest UDP datagram accepted by the StatsD and Graphite listeners
+const maxUDPPacket = 65535
+
+// Translates StatsD lines into TAS messages:
+//
+//	counters (c)                 INCR of the value divided by the sample rate
+//	gauges (g)                   GAUGE, "+n" and "-n" change the last value
+//	                             (see tree.GaugeDelta)
+//	timers, histograms (ms, h, d) APPEND of the value
+//	sets (s)                     APPEND of the member as a string
+type statsdParser struct {
+	prefix string
+}
+
+// Parses a line in the StatsD format, name:value|type[|@rate][|#tags]
+func (p *statsdParser) parse(line string) (m Message, ingestErr *IngestError) {
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return m, reject(ReasonMalformed, "expected name:value|type")
+	}
+	colon := strings.LastIndex(line[:pipe], ":")
+	if colon <= 0 {
+		return m, reject(ReasonMalformed, "expected name:value|type")
+	}
+	fields := strings.Split(line[pipe+1:], "|")
+	name, value, kind := line[:colon], line[colon+1:pipe], fields[0]
+
+	rate := 1.0
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "@") {
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return m, reject(ReasonBadValue, "invalid sample rate %q", field)
+			}
+			rate = r
+		}
+	}
+
+	m = Message{Timestamp: TimestampNow, Key: name}
+	if p.prefix != "" {
+		m.Key = p.prefix + "." + name
+	}
+
+	if kind == "s" {
+		m.Verb, m.Value = "APPEND", []interface{}{value}
+		return m, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return m, reject(ReasonBadValue, "value is not a number: %q", value)
+	}
+
+	switch kind {
+	case "c":
+		count := math.Floor(v/rate + 0.5)
+		// Larger counts cannot be converted to an int without losing precision
+		if math.Abs(count) > 1<<53 {
+			return m, reject(ReasonBadValue, "counter value is out of range: %q", value)
+		}
+		m.Verb, m.Value = "INCR", int(count)
+	case "g":
+		m.Verb, m.Value = "GAUGE", v
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			m.Value = tree.GaugeDelta(v)
+		}
+	case "ms", "h", "d":
+		m.Verb, m.Value = "APPEND", []interface{}{v}
+	default:
+		return m, reject(ReasonBadVerb, "unknown metric type %q", kind)
+	}
+	return m, nil
+}
+
+// Processes a StatsD line and records whether it was accepted
+func (t *TASServer) processStatsd(line string) *IngestError {
+	m, err := t.statsd.parse(line)
+	if err == nil {
+		err = t.ingest(m)
+	}
+	if err != nil {
+		t.logMessage("Rejected StatsD line", "line", line, "reason", err.Reason, "error", err.Err)
+	}
+	t.stats.record(m.Verb, line, err)
+	return err
+}
+
+// Opens the UDP socket of the StatsD listener
+func (t *TASServer) listenStatsd() (err error) {
+	addr := fmt.Sprintf("%s:%s", t.config.StatsDAddress, t.config.StatsDPort)
+	t.statsdConn, err = net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen for StatsD on %s: %v", addr, err)
+	}
+	t.statsd = &statsdParser{prefix: t.config.StatsDPrefix}
+	return nil
+}
+
+// Returns the address of the StatsD listener, nil when it is disabled
+func (t *TASServer) StatsDAddr() net.Addr {
+	if t.statsdConn == nil {
+		return nil
+	}
+	return t.statsdConn.LocalAddr()
+}
+
+// StatsD Receiver
+func (t *TASServer) statsdReceiver() {
+	t.log.Info("Starting StatsD receiver", "addr", t.statsdConn.LocalAddr().String())
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, _, err := t.statsdConn.ReadFrom(buf)
+		if t.closing.Load() {
+			return
+		}
+		if err != nil {
+			t.log.Warn("StatsD receive error", "error", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			t.processStatsd(line)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tas
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tree"
+)
+
+// Timestamp tokens that ask the server to use its own clock
+const (
+	TimestampNow  = "now"
+	TimestampDash = "-"
+)
+
+// Policies for timestamps outside of the acceptance window
+const (
+	SkewReject = "reject"
+	SkewClamp  = "clamp"
+)
+
+// Reasons timestamps are rejected or adjusted
+const (
+	ReasonTooOld = "timestamp_too_old"
+	ReasonTooNew = "timestamp_too_new"
+
+	AdjustServerStamped = "server_stamped"
+	AdjustClampedPast   = "clamped_past"
+	AdjustClampedFuture = "clamped_future"
+)
+
+// Parses a message timestamp into Unix nanoseconds. Integers are read as
+// seconds, milliseconds, microseconds or nanoseconds depending on their
+// magnitude and decimals are read as seconds with a fractional part.
+func parseTimestamp(raw string) (int64, error) {
+	if strings.IndexByte(raw, '.') >= 0 {
+		return tree.ParseTimestamp(raw)
+	}
+
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	abs := ts
+	if abs < 0 {
+		abs = -abs
+	}
+	var unit int64
+	switch {
+	case abs < 1e11:
+		unit = int64(time.Second)
+	case abs < 1e14:
+		unit = int64(time.Millisecond)
+	case abs < 1e17:
+		unit = int64(time.Microsecond)
+	default:
+		unit = int64(time.Nanosecond)
+	}
+	if abs > math.MaxInt64/unit {
+		return 0, strconv.ErrRange
+	}
+	return ts * unit, nil
+}
+
+// Rounds ts down to the start of its bucket
+func (t *TASServer) bucket(ts int64) int64 {
+	width := int64(t.conf().BucketWidth)
+	if width <= 0 {
+		return ts
+	}
+	offset := ts % width
+	if offset < 0 {
+		offset += width
+	}
+	return ts - offset
+}
+
+// Returns the tree key for a timestamp given in a query, so that any
+// accepted spelling of a timestamp matches the bucket it falls in
+func (t *TASServer) bucketKey(raw string) string {
+	ts, err := parseTimestamp(raw)
+	if err != nil {
+		return raw
+	}
+	return tree.FormatTimestamp(t.bucket(ts))
+}
+
+// Resolves the timestamp field of a message to the start of its bucket in
+// Unix nanoseconds, filling in the server time for "now" and "-" and
+// applying the acceptance window from the configuration. Also returns how
+// the timestamp was adjusted, if it was, for the caller to count once the
+// message is stored.
+func (t *TASServer) resolveTimestamp(raw string) (ts int64, adjustment string, ingestErr *IngestError) {
+	if raw == TimestampNow || raw == TimestampDash {
+		return t.bucket(time.Now().UnixNano()), AdjustServerStamped, nil
+	}
+
+	ts, err := parseTimestamp(raw)
+	if err != nil {
+		return 0, "", reject(ReasonBadTimestamp, "timestamp is not a Unix time: %q", raw)
+	}
+	return t.acceptTimestamp(ts)
+}
+
+// Applies the acceptance window to a timestamp in Unix nanoseconds and
+// rounds it down to the start of its bucket, like resolveTimestamp
+func (t *TASServer) acceptTimestamp(ts int64) (int64, string, *IngestError) {
+	now := time.Now().UnixNano()
+	adjustment := ""
+	c := t.conf()
+	if past := int64(c.MaxPastSkew); past > 0 && ts < now-past {
+		if c.SkewPolicy != SkewClamp {
+			return 0, "", reject(ReasonTooOld, "timestamp %s is more than %v in the past", tree.FormatTimestamp(ts), c.MaxPastSkew)
+		}
+		adjustment = AdjustClampedPast
+		ts = now - past
+	}
+	if future := int64(c.MaxFutureSkew); future > 0 && ts > now+future {
+		if c.SkewPolicy != SkewClamp {
+			return 0, "", reject(ReasonTooNew, "timestamp %s is more than %v in the future", tree.FormatTimestamp(ts), c.MaxFutureSkew)
+		}
+		adjustment = AdjustClampedFuture
+		ts = now + future
+	}
+	return t.bucket(ts), adjustment, nil
+}
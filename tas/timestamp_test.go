@@ -0,0 +1,34 @@
+package tas
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestResolveTimestampClamp(t *testing.T) {
+	// Timestamps outside the window are moved to its edges, then rounded
+	// down to their bucket
+
+	svr := &TASServer{config: &TASConfig{MaxPastSkew: time.Minute, MaxFutureSkew: time.Minute, SkewPolicy: SkewClamp, BucketWidth: time.Second}}
+	now := time.Now().Unix()
+	for _, test := range []struct {
+		ts         int64
+		expected   int64
+		adjustment string
+	}{
+		{now - 3600, now - 60, AdjustClampedPast},
+		{now + 3600, now + 60, AdjustClampedFuture},
+		{now - 30, now - 30, ""},
+	} {
+		ts, adjustment, err := svr.resolveTimestamp(strconv.FormatInt(test.ts, 10))
+		if ts%int64(time.Second) != 0 {
+			t.Errorf("%d resolved to %d, outside of a bucket start", test.ts, ts)
+		}
+		ts /= int64(time.Second)
+		// The clock may move by a second while resolving
+		if err != nil || ts < test.expected || ts > test.expected+1 || adjustment != test.adjustment {
+			t.Errorf("%d resolved to %d %q %v instead of %d %q", test.ts, ts, adjustment, err, test.expected, test.adjustment)
+		}
+	}
+}
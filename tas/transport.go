@@ -0,0 +1,361 @@
+package tas
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when sending to or serving a transport that has been closed
+var ErrTransportClosed = errors.New("transport is closed")
+
+// Returned when ZMQ is configured but TAS was built without it
+var ErrNoZMQ = errors.New("TAS was built without ZMQ support (cgo disabled or nozmq build tag)")
+
+// Handles a frame received by a transport and returns the outcome of each
+// of its messages. A frame is a single message, a newline separated batch
+// or a binary frame.
+type FrameHandler func(frame []byte) []IngestResult
+
+// A Transport receives frames from producers and hands them to the server
+type Transport interface {
+	// Receives frames and passes each of them to handle until the
+	// transport is closed
+	Serve(handle FrameHandler) error
+	// Stops the transport, which makes Serve return
+	Close() error
+}
+
+// CURVE security of the ZMQ sockets, disabled without a secret key
+type zmqCurve struct {
+	secretKey  string   // Z85 encoded server secret key
+	clientKeys []string // Z85 encoded public keys of the allowed clients, any client if empty
+}
+
+// Implemented by transports that can hand over the messages they already
+// received when closed. Serve keeps handling them until ctx is done.
+type drainingTransport interface {
+	closeDrain(ctx context.Context) error
+}
+
+// Runs a transport until it is closed
+func (t *TASServer) serveTransport(transport Transport) {
+	t.serving.Add(1)
+	defer t.serving.Add(-1)
+	err := transport.Serve(t.processFrame)
+	if err != nil && !t.closing.Load() {
+		t.log.Error("Transport stopped", "error", err)
+	}
+}
+
+// Handles a frame received by any of the transports
+func (t *TASServer) processFrame(frame []byte) []IngestResult {
+	t.logMessage("Received frame", "frame", quoteFrame(frame))
+	return t.processBatch(frame)
+}
+
+// Returns the reply to a producer for the outcome of a frame: "OK" and the
+// number of messages when all of them were accepted, otherwise "ERR" and a
+// JSON object with the counts and the rejected messages
+func ackReply(results []IngestResult) string {
+	response := ingestResponse{Results: []IngestResult{}}
+	for _, result := range results {
+		if result.OK {
+			response.Accepted++
+		} else {
+			response.Rejected++
+			response.Results = append(response.Results, result)
+		}
+	}
+	if response.Rejected == 0 {
+		return fmt.Sprintf("OK %d", response.Accepted)
+	}
+	returnVal, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Sprintf("ERR {\"accepted\":%d,\"rejected\":%d}", response.Accepted, response.Rejected)
+	}
+	return "ERR " + string(returnVal)
+}
+
+// In-process transport for programs that embed TAS, and for tests
+type ChanTransport struct {
+	frames    chan chanFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type chanFrame struct {
+	frame   []byte
+	results chan []IngestResult
+}
+
+// Returns a new in-process transport
+func NewChanTransport() *ChanTransport {
+	return &ChanTransport{
+		frames: make(chan chanFrame),
+		done:   make(chan struct{}),
+	}
+}
+
+// Hands a frame to the server and waits for the outcome of its messages
+func (c *ChanTransport) Send(frame []byte) ([]IngestResult, error) {
+	f := chanFrame{frame: frame, results: make(chan []IngestResult, 1)}
+	select {
+	case c.frames <- f:
+	case <-c.done:
+		return nil, ErrTransportClosed
+	}
+	return <-f.results, nil
+}
+
+func (c *ChanTransport) Serve(handle FrameHandler) error {
+	for {
+		select {
+		case f := <-c.frames:
+			f.results <- handle(f.frame)
+		case <-c.done:
+			return nil
+		}
+	}
+}
+
+func (c *ChanTransport) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// Transport that reads newline separated messages from persistent TCP
+// connections, e.g. from netcat. Limits must be set before calling Serve,
+// or changed with SetLimits while serving.
+//
+// Binary frames are not accepted: they may contain newlines, so the line
+// framing would split them. A connection that sends one is closed, after an
+// ERR reply in acknowledged mode.
+type TCPTransport struct {
+	MaxLineBytes   int           // Longest line accepted, longer lines close the connection (0 for bufio's default)
+	IdleTimeout    time.Duration // Connections without traffic for this long are closed (0 to disable)
+	MaxConnections int           // Connections beyond this number are refused (0 for no limit)
+	Ack            bool          // Reply to every line with "OK 1" or "ERR" and a JSON object
+	Logger         *slog.Logger  // Logger for connection problems (slog's default if nil)
+
+	listener net.Listener
+	stats    TCPStats
+	wg       sync.WaitGroup // Connections being served
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// Connection metrics of a TCP transport
+type TCPStats struct {
+	OpenConnections    int64 `json:"open_connections"`
+	TotalConnections   int64 `json:"total_connections"`
+	RefusedConnections int64 `json:"refused_connections"`
+	IdleTimeouts       int64 `json:"idle_timeouts"`
+	LinesTooLong       int64 `json:"lines_too_long"`
+	BinaryFrames       int64 `json:"binary_frames"`
+	Lines              int64 `json:"lines"`
+	Bytes              int64 `json:"bytes"`
+}
+
+// Returns a TCP transport listening on addr, e.g. "0.0.0.0:7452"
+func NewTCPTransport(addr string) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPTransport{
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}, nil
+}
+
+// Returns the address the transport is listening on
+func (c *TCPTransport) Addr() net.Addr {
+	return c.listener.Addr()
+}
+
+// Returns a snapshot of the connection metrics
+func (c *TCPTransport) Stats() TCPStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *TCPTransport) Serve(handle FrameHandler) error {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if c.isClosed() {
+				// Let the lines being handled finish
+				c.wg.Wait()
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.serveConn(conn, handle)
+		}()
+	}
+}
+
+// Reads lines from a connection until it is closed, goes idle or sends a
+// line that is too long
+func (c *TCPTransport) serveConn(conn net.Conn, handle FrameHandler) {
+	if !c.track(conn) {
+		conn.Close()
+		return
+	}
+	defer c.untrack(conn)
+
+	maxLineBytes, idleTimeout, ack := c.limits()
+	reader := &idleReader{conn: conn, timeout: idleTimeout}
+	scanner := bufio.NewScanner(&countingReader{reader: reader, transport: c})
+	if maxLineBytes > 0 {
+		size := 4096
+		if maxLineBytes < size {
+			size = maxLineBytes
+		}
+		scanner.Buffer(make([]byte, 0, size), maxLineBytes)
+	}
+	for {
+		// Pick up the limits changed with SetLimits
+		_, reader.timeout, ack = c.limits()
+		if !scanner.Scan() {
+			break
+		}
+		c.count(func(s *TCPStats) { s.Lines++ })
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if IsBinary([]byte(line)) {
+			c.count(func(s *TCPStats) { s.BinaryFrames++ })
+			c.logger().Warn("Closing TCP connection that sent a binary frame", "remote", conn.RemoteAddr().String())
+			if c.Ack {
+				c.ack(conn, []IngestResult{{Line: 1, Reason: ReasonMalformed, Error: "binary frames are not accepted over TCP"}})
+			}
+			break
+		}
+		results := handle([]byte(line))
+		if ack && !c.ack(conn, results) {
+			break
+		}
+	}
+
+	err := scanner.Err()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.count(func(s *TCPStats) { s.IdleTimeouts++ })
+	} else if err == bufio.ErrTooLong {
+		c.count(func(s *TCPStats) { s.LinesTooLong++ })
+		c.logger().Warn("Closing TCP connection with a line over the limit", "remote", conn.RemoteAddr().String(), "max_line_bytes", maxLineBytes)
+	}
+}
+
+// Replies to a line on connections in acknowledged mode. Returns false when
+// the reply could not be written.
+func (c *TCPTransport) ack(conn net.Conn, results []IngestResult) bool {
+	_, err := fmt.Fprintln(conn, ackReply(results))
+	return err == nil
+}
+
+// Returns the logger of the transport
+func (c *TCPTransport) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
+// Changes the limits while serving. A new line length limit only applies
+// to new connections.
+func (c *TCPTransport) SetLimits(maxLineBytes int, idleTimeout time.Duration, maxConnections int, ack bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MaxLineBytes = maxLineBytes
+	c.IdleTimeout = idleTimeout
+	c.MaxConnections = maxConnections
+	c.Ack = ack
+}
+
+func (c *TCPTransport) limits() (maxLineBytes int, idleTimeout time.Duration, ack bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.MaxLineBytes, c.IdleTimeout, c.Ack
+}
+
+// Updates the connection metrics
+func (c *TCPTransport) count(update func(*TCPStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update(&c.stats)
+}
+
+func (c *TCPTransport) track(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if c.MaxConnections > 0 && len(c.conns) >= c.MaxConnections {
+		c.stats.RefusedConnections++
+		return false
+	}
+	c.conns[conn] = true
+	c.stats.OpenConnections++
+	c.stats.TotalConnections++
+	return true
+}
+
+func (c *TCPTransport) untrack(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+	c.stats.OpenConnections--
+	conn.Close()
+}
+
+func (c *TCPTransport) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *TCPTransport) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for conn := range c.conns {
+		conn.Close()
+	}
+	return c.listener.Close()
+}
+
+// Counts the bytes read from a connection
+type countingReader struct {
+	reader    io.Reader
+	transport *TCPTransport
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.transport.count(func(s *TCPStats) { s.Bytes += int64(n) })
+	return n, err
+}
@@ -0,0 +1,18 @@
+//go:build !cgo || nozmq
+
+package tas
+
+import (
+	"log/slog"
+)
+
+// ZMQ port of the default configuration, none as it would fail with ErrNoZMQ
+const defaultZMQPort = ""
+
+func newZMQTransport(addr string, curve zmqCurve, log *slog.Logger) (Transport, error) {
+	return nil, ErrNoZMQ
+}
+
+func newZMQAckTransport(addr string, curve zmqCurve, log *slog.Logger) (Transport, error) {
+	return nil, ErrNoZMQ
+}
@@ -0,0 +1,234 @@
+//go:build cgo && !nozmq
+
+package tas
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/pebbe/zmq4"
+)
+
+// ZMQ port of the default configuration
+const defaultZMQPort = "7450"
+
+var zmqAuthOnce sync.Once
+var zmqAuthErr error
+
+// Number of ZAP domains handed out. Every socket secured with CURVE gets
+// its own domain, so that the clients allowed by a server are not allowed
+// by the other servers of the process.
+var zmqAuthDomains atomic.Uint64
+
+// Enables CURVE on a socket before it is bound, so that only clients with
+// an allowed public key can connect and all traffic is encrypted. Returns
+// the ZAP domain of the allowed keys, empty without CURVE.
+func (c zmqCurve) secure(socket *zmq4.Socket) (string, error) {
+	if c.secretKey == "" {
+		return "", nil
+	}
+	if !zmq4.HasCurve() {
+		return "", fmt.Errorf("ZMQ CURVE security is not available in this libzmq")
+	}
+	// The authentication handler is shared by all sockets of the process
+	zmqAuthOnce.Do(func() { zmqAuthErr = zmq4.AuthStart() })
+	if zmqAuthErr != nil {
+		return "", fmt.Errorf("Could not start ZMQ authentication: %v", zmqAuthErr)
+	}
+	domain := fmt.Sprintf("tas-%d", zmqAuthDomains.Add(1))
+	if len(c.clientKeys) == 0 {
+		zmq4.AuthCurveAdd(domain, zmq4.CURVE_ALLOW_ANY)
+	} else {
+		zmq4.AuthCurveAdd(domain, c.clientKeys...)
+	}
+	if err := socket.ServerAuthCurve(domain, c.secretKey); err != nil {
+		zmq4.AuthCurveRemoveAll(domain)
+		return "", fmt.Errorf("Could not enable ZMQ CURVE security: %v", err)
+	}
+	return domain, nil
+}
+
+// Transport that receives messages on a ZMQ PULL socket. Each part of a
+// (possibly multipart) ZMQ message is handled as a frame.
+//
+// ZMQ sockets must not be used by several goroutines at once, so once
+// Serve has started only its goroutine uses the socket: it polls the socket
+// to notice Close, and closes the socket itself.
+type zmqTransport struct {
+	socket *zmq4.Socket
+	domain string // ZAP domain of the allowed CURVE keys
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	closed  bool
+	serving bool
+	drain   context.Context // Bounds the handling of queued messages after Close
+}
+
+// How long Serve waits for a message before checking whether the transport
+// was closed
+const zmqPollInterval = 100 * time.Millisecond
+
+// Returns a ZMQ transport bound to addr, e.g. "tcp://*:7450"
+func newZMQTransport(addr string, curve zmqCurve, log *slog.Logger) (Transport, error) {
+	socket, err := zmq4.NewSocket(zmq4.PULL)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create ZMQ socket: %v", err)
+	}
+	z := &zmqTransport{socket: socket, log: log}
+	if z.domain, err = curve.secure(socket); err != nil {
+		z.closeSocket()
+		return nil, err
+	}
+	err = socket.Bind(addr)
+	if err != nil {
+		z.closeSocket()
+		return nil, fmt.Errorf("Could not bind ZMQ socket: %v", err)
+	}
+	return z, nil
+}
+
+func (z *zmqTransport) Serve(handle FrameHandler) error {
+	z.log.Info("Starting ZMQ receiver")
+	return z.receive(func(parts []string) {
+		for _, part := range parts {
+			handle([]byte(part))
+		}
+	})
+}
+
+// Passes the parts of every message received to handle until the
+// transport is closed, then the messages already queued on the socket
+// until there are none left or the drain context is done, and closes the
+// socket
+func (z *zmqTransport) receive(handle func(parts []string)) error {
+	z.mu.Lock()
+	if z.closed {
+		z.mu.Unlock()
+		return ErrTransportClosed
+	}
+	z.serving = true
+	z.mu.Unlock()
+	defer z.closeSocket()
+
+	poller := zmq4.NewPoller()
+	poller.Add(z.socket, zmq4.POLLIN)
+	for !z.isClosed() {
+		polled, err := poller.Poll(zmqPollInterval)
+		if err != nil {
+			z.log.Warn("ZMQ poll error", "error", err)
+			continue
+		}
+		if len(polled) == 0 {
+			continue
+		}
+		parts, err := z.socket.RecvMessage(zmq4.DONTWAIT)
+		if err != nil {
+			z.log.Warn("ZMQ receive error", "error", err)
+			continue
+		}
+		handle(parts)
+	}
+
+	z.mu.Lock()
+	drain := z.drain
+	z.mu.Unlock()
+	drained := 0
+	for drain.Err() == nil {
+		parts, err := z.socket.RecvMessage(zmq4.DONTWAIT)
+		if err != nil {
+			if zmq4.AsErrno(err) != zmq4.Errno(syscall.EAGAIN) {
+				z.log.Warn("ZMQ receive error", "error", err)
+			}
+			break
+		}
+		handle(parts)
+		drained++
+	}
+	if drained > 0 {
+		z.log.Info("Handled queued ZMQ messages after closing", "messages", drained)
+	}
+	return nil
+}
+
+func (z *zmqTransport) isClosed() bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.closed
+}
+
+// Makes Serve return within zmqPollInterval, after it closed the socket.
+// The socket of a transport that is not served is closed right away.
+func (z *zmqTransport) Close() error {
+	return z.closeDrain(context.Background())
+}
+
+// Closes the transport like Close, but lets Serve handle the messages
+// already queued on the socket until ctx is done
+func (z *zmqTransport) closeDrain(ctx context.Context) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	z.drain = ctx
+	if z.serving {
+		return nil
+	}
+	return z.closeSocket()
+}
+
+// Closes the socket and removes the CURVE keys it allowed
+func (z *zmqTransport) closeSocket() error {
+	if z.domain != "" {
+		zmq4.AuthCurveRemoveAll(z.domain)
+	}
+	return z.socket.Close()
+}
+
+// Transport that receives messages on a ZMQ REP socket and replies to each
+// of them with an acknowledgement (see ackReply). The reply to a multipart
+// message has one part for each part of the request.
+type zmqAckTransport struct {
+	zmqTransport
+}
+
+// Returns a ZMQ acknowledged transport bound to addr, e.g. "tcp://*:7453"
+func newZMQAckTransport(addr string, curve zmqCurve, log *slog.Logger) (Transport, error) {
+	socket, err := zmq4.NewSocket(zmq4.REP)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create ZMQ REP socket: %v", err)
+	}
+	z := &zmqAckTransport{zmqTransport{socket: socket, log: log}}
+	if z.domain, err = curve.secure(socket); err != nil {
+		z.closeSocket()
+		return nil, err
+	}
+	err = socket.Bind(addr)
+	if err != nil {
+		z.closeSocket()
+		return nil, fmt.Errorf("Could not bind ZMQ REP socket: %v", err)
+	}
+	return z, nil
+}
+
+func (z *zmqAckTransport) Serve(handle FrameHandler) error {
+	z.log.Info("Starting ZMQ acknowledged receiver")
+	return z.receive(func(parts []string) {
+		replies := make([]interface{}, len(parts))
+		for i, part := range parts {
+			replies[i] = ackReply(handle([]byte(part)))
+		}
+		if _, err := z.socket.SendMessage(replies...); err != nil {
+			z.log.Warn("ZMQ reply error", "error", err)
+		}
+	})
+}
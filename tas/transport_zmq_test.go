@@ -0,0 +1,148 @@
+//go:build cgo && !nozmq
+
+package tas
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/pebbe/zmq4"
+)
+
+func curveRequest(t *testing.T, port, serverKey, publicKey, secretKey string) (string, error) {
+	// Sends a message with CURVE to an acknowledged transport and returns
+	// the reply, or an error if there is none within a second
+
+	req, err := zmq4.NewSocket(zmq4.REQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer req.Close()
+	req.SetLinger(0)
+	req.SetRcvtimeo(time.Second)
+	if err = req.ClientAuthCurve(serverKey, publicKey, secretKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = req.Connect("tcp://localhost:" + port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = req.Send("INCR now zmq.curve 1", 0); err != nil {
+		return "", err
+	}
+	return req.Recv(0)
+}
+
+func TestZMQCurveClients(t *testing.T) {
+	// Each socket only lets in its own clients, whatever the other sockets
+	// of the process allow
+
+	serverPublic, serverSecret, _ := NewCurveKeypair()
+	publicA, secretA, _ := NewCurveKeypair()
+	publicB, secretB, _ := NewCurveKeypair()
+	for _, server := range []struct {
+		port, allowed string
+	}{
+		{"7472", publicA},
+		{"7473", publicB},
+	} {
+		transport, err := newZMQAckTransport("tcp://*:"+server.port, zmqCurve{secretKey: serverSecret, clientKeys: []string{server.allowed}}, slog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer transport.Close()
+		go transport.Serve(func(frame []byte) []IngestResult {
+			return []IngestResult{{Line: 1, OK: true}}
+		})
+	}
+
+	for _, test := range []struct {
+		port, public, secret string
+		allowed              bool
+	}{
+		{"7472", publicA, secretA, true},
+		{"7472", publicB, secretB, false},
+		{"7473", publicB, secretB, true},
+		{"7473", publicA, secretA, false},
+	} {
+		reply, err := curveRequest(t, test.port, serverPublic, test.public, test.secret)
+		if test.allowed && reply != "OK 1" {
+			t.Errorf("Allowed client got %q: %v on port %s", reply, err, test.port)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("Unlisted client got %q on port %s", reply, test.port)
+		}
+	}
+}
+
+func TestZMQDrain(t *testing.T) {
+	// Messages queued on the socket when the transport is closed are still
+	// handled, unless the drain context is done
+
+	for _, test := range []struct {
+		port    string
+		expired bool
+	}{
+		{"7474", false},
+		{"7475", true},
+	} {
+		transport, err := newZMQTransport("tcp://*:"+test.port, zmqCurve{}, slog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		handled := make(chan string, 100)
+		release := make(chan struct{})
+		served := make(chan error)
+		go func() {
+			served <- transport.Serve(func(frame []byte) []IngestResult {
+				// Hold the first message, so that the others queue up
+				if len(handled) == 0 {
+					<-release
+				}
+				handled <- string(frame)
+				return nil
+			})
+		}()
+
+		push, err := zmq4.NewSocket(zmq4.PUSH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		push.SetLinger(0)
+		if err = push.Connect("tcp://localhost:" + test.port); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			push.Send("INCR now zmq.drain 1", 0)
+		}
+		// Let the messages reach the socket
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.expired {
+			cancel()
+		}
+		transport.(drainingTransport).closeDrain(ctx)
+		close(release)
+		select {
+		case err = <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve did not return after closing")
+		}
+		cancel()
+		push.Close()
+
+		if err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+		if test.expired && len(handled) != 1 {
+			t.Errorf("Handled %d messages with an expired drain context", len(handled))
+		}
+		if !test.expired && len(handled) != 10 {
+			t.Errorf("Handled %d of 10 messages", len(handled))
+		}
+	}
+}
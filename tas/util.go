@@ -1,9 +1,9 @@
 package tas
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -12,8 +12,15 @@ import (
 	"github.com/chango/tas/tree"
 )
 
-//Generates a json for the data.
-func TreePrinter(node *tree.Node) string {
+// A node of the tree as the TREE page draws it
+type treeNode struct {
+	Name     string      `json:"name"`
+	Parent   string      `json:"parent"`
+	Children interface{} `json:"children,omitempty"` // []*treeNode, nil for leafs
+}
+
+// Returns the node and its descendants as the TREE page draws them
+func newTreeNode(node *tree.Node) *treeNode {
 
 	//To see if the node is the datanode
 	var parentName string = "null"
@@ -36,80 +43,74 @@ func TreePrinter(node *tree.Node) string {
 			output := fmt.Sprintf("%v", val_slice)
 			nodeName = "value: " + output + " timestamp:(" + nodeName + ")"
 
+			// Gauge value
+		} else if val_gauge, ok := node.Value.(tree.Gauge); ok {
+			nodeName = "value: " + strconv.FormatFloat(float64(val_gauge), 'g', -1, 64) + " timestamp:(" + nodeName + ")"
 		}
 	}
 
-	var output string = "{\"name\": \"" + nodeName + "\", \"parent\": \"" + parentName + "\""
+	output := &treeNode{Name: nodeName, Parent: parentName}
 	//We check if the parentName is null just so the datanode appears even if it has no children
-	if len(node.GetAllChildren()) != 0 || parentName == "null" {
-		output += ", \"children\": [ "
-		for _, n := range node.Children {
-			output += TreePrinter(n)
-			output += ","
+	if num_children != 0 || parentName == "null" {
+		keys := make([]string, 0, num_children)
+		for key := range node.Children {
+			keys = append(keys, key)
 		}
-		output += "]"
+		sort.Strings(keys)
+		children := make([]*treeNode, 0, num_children)
+		for _, key := range keys {
+			children = append(children, newTreeNode(node.Children[key]))
+		}
+		output.Children = children
 	}
-	output += "}"
 	return output
 }
 
-// Counts the number of nodes for each timestamp
-// and returns the result in json format
-func TSCounters(timestamps *map[string]*tree.Node) string {
-
-	ts_counts := make(map[string]int)
-
-	// traverse timestampNodes
-	// and calculates the number of nodes for each timestamp
-	for ts, children := range *timestamps {
-		leaves := *children
-		for _, _ = range leaves.Children {
-			if _, ok := ts_counts[ts]; ok {
-				ts_counts[ts]++
-			} else {
-				ts_counts[ts] = 1
-			}
-		}
-	}
-
-	//Print ts_counts as a string in json format
-	var output string
-	for ts, count := range ts_counts {
-		ts_int, _ := strconv.Atoi(ts)
-		output += fmt.Sprintf(" {\"timestamp\":%d,\"count\":%d},", ts_int, count)
+//Generates a json for the data.
+func TreePrinter(node *tree.Node) string {
+	returnVal, err := json.Marshal(newTreeNode(node))
+	if err != nil {
+		return "{}"
 	}
-	output = strings.TrimRight(output, ",")
-	return output
+	return string(returnVal)
 }
 
-// Small wrapper for debug logging
-type debug struct {
-	debug bool
+// Number of nodes of a timestamp
+type tsCount struct {
+	Timestamp json.Number `json:"timestamp"`
+	Count     int         `json:"count"`
 }
 
-func (d *debug) SetLogLevel() {
-	val := os.Getenv("DEBUG")
-	if val == "1" {
-		d.debug = true
+// Counts the number of nodes for each timestamp, sorted by timestamp
+func countTimestamps(timestamps *map[string]*tree.Node) []tsCount {
+	ts_counts := make(map[int64]int)
+	for _, leaves := range *timestamps {
+		if len(leaves.Children) > 0 {
+			ts_counts[leaves.Timestamp] += len(leaves.Children)
+		}
 	}
-}
-
-func (d *debug) Debug(v ...interface{}) {
-	if d.debug {
-		output := []interface{}{"DEBUG:"}
-		output = append(output, v...)
-		log.Println(output...)
+	sorted := make([]int64, 0, len(ts_counts))
+	for ts := range ts_counts {
+		sorted = append(sorted, ts)
 	}
-}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
 
-func (d *debug) Info(v ...interface{}) {
-	output := []interface{}{"INFO:"}
-	output = append(output, v...)
-	log.Println(output...)
+	counts := make([]tsCount, 0, len(sorted))
+	for _, ts := range sorted {
+		counts = append(counts, tsCount{json.Number(tree.FormatTimestamp(ts)), ts_counts[ts]})
+	}
+	return counts
 }
 
-var tasLog = &debug{}
-
-func init() {
-	tasLog.SetLogLevel()
+// Counts the number of nodes for each timestamp
+// and returns the result in json format
+func TSCounters(timestamps *map[string]*tree.Node) string {
+	var output []string
+	for _, count := range countTimestamps(timestamps) {
+		returnVal, err := json.Marshal(count)
+		if err == nil {
+			output = append(output, string(returnVal))
+		}
+	}
+	return strings.Join(output, ",")
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+type apiResponse struct {
+	Data  interface{}
+	Error *struct {
+		Status  int
+		Code    string
+		Message string
+	}
+}
+
+// Sends a request to the server's handler and decodes the API envelope
+func apiRequest(t *testing.T, svr *tas.TASServer, method, path, body string) (int, apiResponse) {
+	var resp apiResponse
+	code := serveJSON(t, svr, httptest.NewRequest(method, path, strings.NewReader(body)), &resp)
+	return code, resp
+}
+
+func TestAPI(t *testing.T) {
+	// The API wraps data and errors in envelopes with matching status codes
+
+	c, _ := testingConfig()
+	svr := startTestingServer(t, c)
+
+	code, resp := apiRequest(t, svr, "POST", "/api/v1/ingest", "INCR now api.a 10\nINCR now api.b 5")
+	if code != http.StatusOK || resp.Error != nil {
+		t.Fatalf("Ingest returned %d %+v", code, resp.Error)
+	}
+
+	code, resp = apiRequest(t, svr, "GET", "/api/v1/values?key=api.a&i=2", "")
+	if code != http.StatusOK || resp.Data != 10.0 {
+		t.Errorf("api.a returned %d %+v", code, resp)
+	}
+	code, resp = apiRequest(t, svr, "GET", "/api/v1/values?key=api.*", "")
+	if data, ok := resp.Data.(map[string]interface{}); code != http.StatusOK || !ok || len(data) != 2 {
+		t.Errorf("api.* returned %d %+v", code, resp)
+	}
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{"GET", "/api/v1/values?key=api.a&i=abc", http.StatusBadRequest, "bad_parameter"},
+		{"GET", "/api/v1/values?key=api.a&i=0", http.StatusBadRequest, "bad_parameter"},
+		{"GET", "/api/v1/values?key=api.a&t=yesterday", http.StatusBadRequest, "bad_parameter"},
+		{"GET", "/api/v1/values", http.StatusBadRequest, "bad_parameter"},
+		{"GET", "/api/v1/values?key=api.missing", http.StatusNotFound, "not_found"},
+		{"GET", "/api/v1/values?key=missing.*", http.StatusNotFound, "not_found"},
+		{"GET", "/api/v1/nothing", http.StatusNotFound, "not_found"},
+		{"GET", "/api/v1/ingest", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"POST", "/api/v1/reload", http.StatusNotImplemented, "not_implemented"},
+	} {
+		code, resp := apiRequest(t, svr, test.method, test.path, "")
+		if code != test.status || resp.Error == nil || resp.Error.Code != test.code || resp.Error.Status != test.status {
+			t.Errorf("%s %s returned %d %+v, expected %d %s", test.method, test.path, code, resp.Error, test.status, test.code)
+		}
+	}
+
+	// The legacy endpoint still returns the bare value
+	w := serve(svr, httptest.NewRequest("GET", "/GET?key=api.missing", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "null" {
+		t.Errorf("/GET returned %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	// Refused API requests get an error envelope
+
+	c, _ := testingConfig()
+	c.HTTPCredentials = []tas.HTTPCredential{{Token: "reader", Scope: tas.ScopeRead}}
+	svr := newTestingServer(t, c)
+
+	code, resp := apiRequest(t, svr, "GET", "/api/v1/diag", "")
+	if code != http.StatusUnauthorized || resp.Error == nil || resp.Error.Code != "unauthorized" {
+		t.Errorf("Unauthenticated request returned %d %+v", code, resp.Error)
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/ingest", strings.NewReader("INCR now api.a 1"))
+	r.Header.Set("Authorization", "Bearer reader")
+	w := serve(svr, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"forbidden"`) {
+		t.Errorf("Read scope ingest returned %d %q", w.Code, w.Body.String())
+	}
+}
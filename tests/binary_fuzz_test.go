@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func binaryTestMessages() []tas.Message {
+	return []tas.Message{
+		{Verb: "INCR", UnixNano: 1404148628000000000, Key: "cart.seafood.basket1", Value: 5},
+		{Verb: "INCR", Timestamp: "now", Key: "cart.seafood.basket2", Value: -3},
+		{Verb: "INCR", UnixNano: 0, Key: "cart.seafood.epoch", Value: 1},
+		{Verb: "APPEND", UnixNano: 1404148628250000000, Key: "cart.meat.basket1",
+			Value: []interface{}{1.0, 2.5, "abc", true, nil, map[string]interface{}{"a": 1.0}}},
+		{Verb: "GAUGE", UnixNano: 1404148629000000000, Key: "cart.meat.weight", Value: 12.5},
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	// Messages decode to what was encoded
+
+	messages := binaryTestMessages()
+	frame, err := tas.EncodeBinary(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tas.IsBinary(frame) {
+		t.Error("Encoded frame has no magic prefix")
+	}
+
+	decoded, err := tas.DecodeBinary(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, messages) {
+		t.Errorf("Decoded %v instead of %v", decoded, messages)
+	}
+}
+
+func TestBinaryTextTimestamp(t *testing.T) {
+	// Timestamps in the text form are encoded as Unix nanoseconds
+
+	text, err := tas.EncodeBinary([]tas.Message{{Verb: "INCR", Timestamp: "1404148628.25", Key: "cart", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numeric, _ := tas.EncodeBinary([]tas.Message{{Verb: "INCR", UnixNano: 1404148628250000000, Key: "cart", Value: 1}})
+	if !reflect.DeepEqual(text, numeric) {
+		t.Errorf("Encoded %q instead of %q", text, numeric)
+	}
+}
+
+func TestBinaryIngest(t *testing.T) {
+	// Binary records are stored, with the server time or their own, so that
+	// the Unix epoch is rejected as too old instead of taken as "now"
+
+	frame, err := tas.EncodeBinary([]tas.Message{
+		{Verb: "INCR", Timestamp: "now", Key: "binary.now", Value: 2},
+		{Verb: "INCR", UnixNano: time.Now().UnixNano(), Key: "binary.at", Value: 3},
+		{Verb: "INCR", UnixNano: 0, Key: "binary.epoch", Value: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := sendRejected(t, string(frame), "NOPE now binary.done 1")
+	if letter := letters.Messages[1]; letter.Message != "INCR 0 binary.epoch 4" || letter.Reason != tas.ReasonTooOld {
+		t.Errorf("Dead letter %+v instead of the epoch rejected as %s", letter, tas.ReasonTooOld)
+	}
+	for key, expected := range map[string]float64{"binary.now": 2, "binary.at": 3} {
+		data, _ := ReadGetServer(key, t)
+		if data[key] != expected {
+			t.Errorf("%s stored as %v instead of %v", key, data[key], expected)
+		}
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	// A truncated frame only decodes the messages that are complete
+
+	messages := binaryTestMessages()
+	frame, _ := tas.EncodeBinary(messages)
+	for i := 0; i < len(frame); i++ {
+		decoded, _ := tas.DecodeBinary(frame[:i])
+		if len(decoded) > len(messages) {
+			t.Fatalf("Frame truncated to %d bytes decoded %d messages", i, len(decoded))
+		}
+		if len(decoded) > 0 && !reflect.DeepEqual(decoded, messages[:len(decoded)]) {
+			t.Errorf("Frame truncated to %d bytes decoded %v", i, decoded)
+		}
+	}
+}
+
+func FuzzDecodeBinary(f *testing.F) {
+	// The decoder never panics and whatever it decodes can be encoded again
+
+	frame, _ := tas.EncodeBinary(binaryTestMessages())
+	f.Add(frame)
+	f.Add(append(append([]byte{}, tas.BinaryMagic...), tas.BinaryVersion))
+	f.Add([]byte("INCR 1404148628 cart.seafood 5"))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		messages, _ := tas.DecodeBinary(frame)
+		if _, err := tas.EncodeBinary(messages); err != nil {
+			t.Errorf("Could not encode decoded messages %v: %v", messages, err)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	// Flags override the environment, which overrides the file
+
+	path := filepath.Join(t.TempDir(), "tas.json")
+	file := `{"http_port": 8000, "tcp_port": "8001", "retention": "2m", "tcp_ack": true,
+		"graphite_rules": ["servers=sum", "servers.load=gauge"]}`
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"TAS_CONFIG=" + path, "TAS_TCP_PORT=9001", "TAS_HTTP_PORT=9000", "PATH=/bin"}
+	args := []string{"-http-port", "10000", "-zmq-port", ""}
+
+	c, err := tas.LoadTASConfig("tas-server", args, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTPPort != "10000" || c.TCPPort != "9001" || c.ZMQPort != "" {
+		t.Errorf("Wrong precedence: http %q tcp %q zmq %q", c.HTTPPort, c.TCPPort, c.ZMQPort)
+	}
+	if c.Retention != 2*time.Minute || !c.TCPAck || len(c.GraphiteRules) != 2 || c.GraphiteRules[1].Mode != tas.GraphiteGauge {
+		t.Errorf("File settings not applied: %+v", c)
+	}
+	if c.GCInterval != tas.NewDefaultTASConfig().GCInterval {
+		t.Errorf("Default GCInterval not kept: %v", c.GCInterval)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	// Invalid settings are reported with where they came from
+
+	path := filepath.Join(t.TempDir(), "tas.json")
+	if err := os.WriteFile(path, []byte(`{"tcp_port": "70000"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		args    []string
+		environ []string
+		err     string
+	}{
+		{[]string{"-tcp-idle-timeout", "5x"}, nil, "flag -tcp-idle-timeout"},
+		{nil, []string{"TAS_HTTP_PROT=80"}, "TAS_HTTP_PROT"},
+		{nil, []string{"TAS_TCP_MAX_CONNECTIONS=many"}, "TAS_TCP_MAX_CONNECTIONS"},
+		{[]string{"-http-port", "http"}, nil, "http_port (flag -http-port)"},
+		{nil, []string{"TAS_SKEW_POLICY=drop"}, "skew_policy (environment variable TAS_SKEW_POLICY)"},
+		{[]string{"-retention", "-1s"}, nil, "retention (flag -retention): must not be negative"},
+		{[]string{"-http-tls-cert-file", "cert.pem"}, nil, "http_tls_cert_file (flag -http-tls-cert-file)"},
+		{[]string{"-config", "/nonexistent/tas.json"}, nil, "configuration file"},
+		{[]string{"-config", path}, nil, "tcp_port (configuration file " + path + ")"},
+	}
+	for _, c := range cases {
+		_, err := tas.LoadTASConfig("tas-server", c.args, c.environ)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v %v: expected an error about %s, got %v", c.args, c.environ, c.err, err)
+		}
+	}
+}
+
+func TestEarlierConfig(t *testing.T) {
+	// A configuration with only the settings of earlier versions runs with
+	// the defaults of the newer ones
+
+	c := &tas.TASConfig{ZMQAddress: "*", HTTPAddress: "0.0.0.0"}
+	svr, err := tas.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Shutdown(context.Background())
+	if err = svr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(svr, httptest.NewRequest("POST", "/INGEST", strings.NewReader("INCR now earlier.key 3")))
+	if w.Code != 200 {
+		t.Fatalf("/INGEST returned %d %q", w.Code, w.Body.String())
+	}
+	if w = serve(svr, httptest.NewRequest("GET", "/GET?key=earlier.key", nil)); w.Body.String() != "3" {
+		t.Errorf("/GET returned %q", w.Body.String())
+	}
+
+	c.Retention = -time.Second
+	var e *tas.SettingError
+	if _, err = tas.New(c); !errors.As(err, &e) || e.Field != "Retention" {
+		t.Errorf("Negative Retention gave %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+type deadLetters struct {
+	Rejected map[string]uint64
+	Messages []tas.DeadLetter
+}
+
+func readDeadLetters(t *testing.T) deadLetters {
+	// Get the output from http://localhost:{http_port}/DEADLETTER
+
+	resp, err := http.Get(find_link("DEADLETTER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var letters deadLetters
+	if err = json.NewDecoder(resp.Body).Decode(&letters); err != nil {
+		t.Fatal(err)
+	}
+	return letters
+}
+
+func sendRejected(t *testing.T, messages ...string) deadLetters {
+	// Sends messages to the testing server and returns the dead letters
+	// once they were processed
+
+	for _, message := range messages {
+		if _, err := testingTransport.Send([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return readDeadLetters(t)
+}
+
+func waitForRejected(t *testing.T, message string) deadLetters {
+	// Returns the dead letters once message is the newest one
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters := readDeadLetters(t)
+		if len(letters.Messages) > 0 && letters.Messages[0].Message == message {
+			return letters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q not rejected", message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeadLetterReasons(t *testing.T) {
+	// Every rejected message is counted under its reason and kept, newest
+	// first
+
+	// Old enough for the GC to delete it soon after the test
+	ts := time.Now().Unix() - 50
+	messages := []struct {
+		message string
+		reason  string
+	}{
+		{"INCR 1404148628 deadletter.key", tas.ReasonMalformed},
+		{"DECR 1404148628 deadletter.key 1", tas.ReasonBadVerb},
+		{"INCR yesterday deadletter.key 1", tas.ReasonBadTimestamp},
+		{"INCR 1404148628 deadletter.key one", tas.ReasonBadValue},
+		{"APPEND 1404148628 deadletter.key {}", tas.ReasonBadValue},
+		{fmt.Sprintf("INCR %d deadletter.conflict 1", ts), tas.ReasonTypeConflict},
+	}
+
+	before := readDeadLetters(t)
+	sent := []string{fmt.Sprintf("APPEND %d deadletter.conflict [1]", ts)}
+	for _, m := range messages {
+		sent = append(sent, m.message)
+	}
+	after := sendRejected(t, sent...)
+
+	expected := make(map[string]uint64)
+	for _, m := range messages {
+		expected[m.reason]++
+	}
+	for reason, n := range expected {
+		if after.Rejected[reason]-before.Rejected[reason] != n {
+			t.Errorf("%d more %s rejections instead of %d", after.Rejected[reason]-before.Rejected[reason], reason, n)
+		}
+	}
+	for i, m := range messages {
+		letter := after.Messages[len(messages)-1-i]
+		if letter.Message != m.message || letter.Reason != m.reason || letter.Error == "" {
+			t.Errorf("Dead letter %+v instead of %q rejected as %s", letter, m.message, m.reason)
+		}
+	}
+}
+
+func TestDeadLetterRing(t *testing.T) {
+	// Only the newest DeadLetterSize messages are kept
+
+	size := tas.NewDefaultTASConfig().DeadLetterSize
+	var messages []string
+	for i := 0; i < size+10; i++ {
+		messages = append(messages, fmt.Sprintf("NOPE 1404148628 deadletter.ring %d", i))
+	}
+	letters := sendRejected(t, messages...)
+	if len(letters.Messages) != size {
+		t.Fatalf("Kept %d dead letters instead of %d", len(letters.Messages), size)
+	}
+	for i, letter := range letters.Messages {
+		if letter.Message != messages[len(messages)-1-i] {
+			t.Fatalf("Dead letter %d is %q instead of %q", i, letter.Message, messages[len(messages)-1-i])
+		}
+	}
+}
+
+func TestDeadLetterTruncated(t *testing.T) {
+	// Long messages are cut in the dead letters
+
+	message := "NOPE 1404148628 deadletter.long " + strings.Repeat("x", 5000)
+	letters := sendRejected(t, message, "NOPE 1404148628 deadletter.long 1")
+
+	letter := letters.Messages[1]
+	if len(letter.Message) > 1100 || !strings.HasPrefix(letter.Message, message[:1000]) || !strings.HasSuffix(letter.Message, "more bytes)") {
+		t.Errorf("Long message kept as %d bytes: %q", len(letter.Message), letter.Message[len(letter.Message)-30:])
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func TestEmbeddedServers(t *testing.T) {
+	// Two servers run in one process, each mounted under its HTTPPrefix in
+	// the mux of the embedding program
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("embedding program"))
+	})
+	for _, prefix := range []string{"/shop", "servers/"} {
+		c, transport := testingConfig()
+		c.HTTPPrefix = prefix
+		svr, err := tas.NewTASServer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.Handle("/"+strings.Trim(prefix, "/")+"/", svr.Handler())
+		transport.Send([]byte("INCR now embed." + strings.Trim(prefix, "/") + " 1"))
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for path, content := range map[string]string{
+		"/":                              "embedding program",
+		"/GET?key=embed.shop":            "embedding program",
+		"/shop/GET?key=embed.shop":       "1",
+		"/shop/GET?key=embed.servers":    "null",
+		"/servers/GET?key=embed.servers": "1",
+		"/servers/GET?key=embed.shop":    "null",
+		"/servers/DIAG":                  `"num_leafs":1`,
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), content) {
+			t.Errorf("%s returned %d %q", path, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func TestExport(t *testing.T) {
+	// /EXPORT renders the keys matched by the rules as OpenMetrics gauges
+
+	c, transport := testingConfig()
+	c.ExportRules = []tas.ExportRule{
+		{Pattern: "shop.{section}.{basket}", Name: "shop_{section}_items", Help: "Items per basket"},
+		{Pattern: "servers.*.load", Name: "server_load"},
+		{Pattern: "servers.web1.load", Name: "server_load"},
+	}
+	svr := startTestingServer(t, c)
+
+	transport.Send([]byte(`INCR now shop.sea-food.basket1 5
+INCR now shop.meat.basket"2 3
+GAUGE now servers.web1.load 0.5
+GAUGE now servers.web2.load 0.25
+APPEND now shop.meat.notes ["x"]`))
+
+	w := serve(svr, httptest.NewRequest("GET", "/EXPORT", nil))
+	body := w.Body.String()
+
+	// The loads of both servers are summed, and web1 is only counted once
+	// although two rules match it
+	expected := `# TYPE server_load gauge
+server_load 0.75
+# TYPE shop_meat_items gauge
+# HELP shop_meat_items Items per basket
+shop_meat_items{basket="basket\"2"} 3
+# TYPE shop_sea_food_items gauge
+# HELP shop_sea_food_items Items per basket
+shop_sea_food_items{basket="basket1"} 5
+# EOF
+`
+	if body != expected {
+		t.Errorf("Exported\n%s\ninstead of\n%s", body, expected)
+	}
+
+	for _, i := range []string{"x", "0", "-5", "NaN", "Inf"} {
+		if w = serve(svr, httptest.NewRequest("GET", "/EXPORT?i="+i, nil)); w.Code != 400 {
+			t.Errorf("/EXPORT?i=%s returned %d", i, w.Code)
+		}
+	}
+}
+
+func TestExportRulesInvalid(t *testing.T) {
+	// Rules that cannot produce valid series are refused
+
+	for _, rule := range []tas.ExportRule{
+		{Pattern: "shop.{section}", Name: "shop_{basket}"},
+		{Pattern: "shop..x", Name: "shop"},
+		{Pattern: "shop.{sec-tion}", Name: "shop"},
+		{Pattern: "shop.*", Name: ""},
+	} {
+		c := tas.NewDefaultTASConfig()
+		c.ExportRules = []tas.ExportRule{rule}
+		if err := c.Validate(); err == nil {
+			t.Errorf("Rule %+v accepted", rule)
+		}
+	}
+}
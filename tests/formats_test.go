@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryFormats(t *testing.T) {
+	// Values are flattened to CSV and NDJSON rows, per key or per bucket
+
+	c, transport := testingConfig()
+	svr := startTestingServer(t, c)
+
+	ts1 := time.Now().Unix() - 2
+	ts2 := ts1 + 1
+	transport.Send([]byte(fmt.Sprintf(`INCR %d fmt.a 3
+INCR %d fmt.a 4
+INCR %d fmt.b,c 1
+APPEND %d fmt.d ["x"]`, ts1, ts2, ts1, ts2)))
+
+	for _, test := range []struct {
+		path, accept, contentType, body string
+	}{
+		{"/api/v1/values?key=fmt.*&format=csv", "", "text/csv; charset=utf-8", `key,timestamp,value
+fmt.a,,0.7
+"fmt.b,c",,1
+fmt.d,,"[""x""]"
+`},
+		{"/api/v1/values?key=fmt.a&buckets=true", "text/csv", "text/csv; charset=utf-8", fmt.Sprintf(`key,timestamp,value
+fmt.a,%d,3
+fmt.a,%d,4
+`, ts1, ts2)},
+		{"/api/v1/values?key=fmt.*&buckets=1", "application/x-ndjson", "application/x-ndjson", fmt.Sprintf(`{"key":"fmt.a","timestamp":%d,"value":3}
+{"key":"fmt.a","timestamp":%d,"value":4}
+{"key":"fmt.b,c","timestamp":%d,"value":1}
+{"key":"fmt.d","timestamp":%d,"value":["x"]}
+`, ts1, ts2, ts1, ts2)},
+		{"/GET?key=fmt.a&format=ndjson", "", "application/x-ndjson", `{"key":"fmt.a","value":0.7}
+`},
+		{fmt.Sprintf("/GET?key=fmt.a&buckets=true&t=%d", ts2), "", "", fmt.Sprintf(`[{"key":"fmt.a","timestamp":%d,"value":4}]`, ts2)},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := serve(svr, r)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("%s returned %d\n%s\ninstead of\n%s", test.path, w.Code, w.Body.String(), test.body)
+		}
+		if test.contentType != "" && w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s has Content-Type %q", test.path, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Keys a spreadsheet would run as formulas are escaped, values are not
+	transport.Send([]byte(fmt.Sprintf("INCR %d =cmd.cell 1\nINCR %d @sum.cell 1\nINCR %d -1+1.cell -2\nINCR %d plain.cell 1", ts1, ts1, ts1, ts1)))
+	w := serve(svr, httptest.NewRequest("GET", "/api/v1/values?key=*.cell&format=csv&buckets=true", nil))
+	if expected := fmt.Sprintf("key,timestamp,value\n'-1+1.cell,%d,-2\n'=cmd.cell,%d,1\n'@sum.cell,%d,1\nplain.cell,%d,1\n", ts1, ts1, ts1, ts1); w.Body.String() != expected {
+		t.Errorf("Formula keys returned\n%s\ninstead of\n%s", w.Body.String(), expected)
+	}
+
+	for _, path := range []string{"/api/v1/values?key=fmt.a&format=xml", "/api/v1/values?key=fmt.a&buckets=maybe"} {
+		w := serve(svr, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "bad_parameter") {
+			t.Errorf("%s returned %d %q", path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func dialGraphite(t *testing.T, network string) net.Conn {
+	// Connects to the Graphite listener of the testing server
+
+	conn, err := net.Dial(network, testingServer.GraphiteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func closedByServer(conn net.Conn, within time.Duration) bool {
+	// Reports whether the server closes conn within the given time
+
+	conn.SetReadDeadline(time.Now().Add(within))
+	_, err := bufio.NewReader(conn).ReadByte()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestGraphite(t *testing.T) {
+	// Graphite lines are stored as sums or gauges following the rules, and
+	// lines that cannot be stored as they are are rejected
+
+	ts := time.Now().Unix() - 5
+	lines := []struct {
+		line   string
+		reason string
+	}{
+		{fmt.Sprintf("servers.web.requests 3 %d", ts), ""},
+		{fmt.Sprintf("servers.web.requests 2 %d", ts), ""},
+		{fmt.Sprintf("servers.web.requests 1.5 %d", ts), tas.ReasonBadValue},
+		{fmt.Sprintf("servers.web.requests 1e300 %d", ts), tas.ReasonBadValue},
+		{fmt.Sprintf("servers.db.load 0.5 %d", ts), ""},
+		{fmt.Sprintf("servers.db.load 0.75 %d", ts+1), ""},
+		{fmt.Sprintf("servers.dbx.queries 4 %d", ts), ""},
+		{"weather.temperature 21.5 -1", ""},
+		{"weather.pressure 1013", tas.ReasonMalformed},
+		{"weather.pressure 1013 -1 extra", tas.ReasonMalformed},
+		{"weather.pressure high -1", tas.ReasonBadValue},
+		{"weather.pressure 1013 yesterday", tas.ReasonBadTimestamp},
+	}
+	conn := dialGraphite(t, "tcp")
+	for _, l := range lines {
+		fmt.Fprintln(conn, l.line)
+	}
+	conn.Close()
+	letters := waitForRejected(t, lines[len(lines)-1].line)
+
+	for key, expected := range map[string]interface{}{
+		fmt.Sprintf("servers.web.requests&t=%d", ts): 5.0,
+		"servers.db.load": 0.75,
+		fmt.Sprintf("servers.dbx.queries&t=%d", ts): 4.0,
+		"weather.temperature":                       21.5,
+		"weather.pressure":                          nil,
+	} {
+		data, _ := ReadGetServer(key, t)
+		if data[key] != expected {
+			t.Errorf("%s is %v instead of %v", key, data[key], expected)
+		}
+	}
+
+	rejected := make(map[string]string)
+	for _, letter := range letters.Messages {
+		rejected[letter.Message] = letter.Reason
+	}
+	for _, l := range lines {
+		if rejected[l.line] != l.reason {
+			t.Errorf("%q rejected as %q instead of %q", l.line, rejected[l.line], l.reason)
+		}
+	}
+}
+
+func TestGraphiteUDP(t *testing.T) {
+	// Datagrams may carry several lines
+
+	conn := dialGraphite(t, "udp")
+	defer conn.Close()
+	fmt.Fprint(conn, "udp.temperature 18 -1\nudp.pressure high -1\n")
+	waitForRejected(t, "udp.pressure high -1")
+
+	if data, _ := ReadGetServer("udp.temperature", t); data["udp.temperature"] != 18.0 {
+		t.Errorf("udp.temperature is %v instead of 18", data["udp.temperature"])
+	}
+}
+
+func TestGraphiteLimits(t *testing.T) {
+	// Connections that go idle or send a line over the limit are closed,
+	// and connections over the limit are refused
+
+	idle := dialGraphite(t, "tcp")
+	defer idle.Close()
+	// Traffic before the timeout keeps the connection open
+	for i := 0; i < 3; i++ {
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprintln(idle, "limits.idle 1 -1")
+	}
+	long := dialGraphite(t, "tcp")
+	defer long.Close()
+	// Make sure the server serves both connections before the third one
+	fmt.Fprintln(long, "limits.long high -1")
+	waitForRejected(t, "limits.long high -1")
+	refused := dialGraphite(t, "tcp")
+	defer refused.Close()
+
+	if !closedByServer(refused, time.Second) {
+		t.Error("Connection over the limit not refused")
+	}
+	fmt.Fprintln(long, "limits.long "+strings.Repeat("1", 300)+" -1")
+	if !closedByServer(long, time.Second) {
+		t.Error("Connection that sent a line over the limit not closed")
+	}
+	if !closedByServer(idle, 2*time.Second) {
+		t.Error("Idle connection not closed")
+	}
+	if data, _ := ReadGetServer("limits.idle", t); data["limits.idle"] != 1.0 {
+		t.Errorf("limits.idle is %v instead of 1", data["limits.idle"])
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+type healthResponse struct {
+	Status string
+	Checks []struct {
+		Name string
+		OK   bool
+	}
+}
+
+// Requests a probe from the server's handler
+func probe(t *testing.T, svr *tas.TASServer, path string) (int, healthResponse) {
+	var resp healthResponse
+	code := serveJSON(t, svr, httptest.NewRequest("GET", path, nil), &resp)
+	return code, resp
+}
+
+func TestHealthProbes(t *testing.T) {
+	// /readyz fails until the server runs and /healthz fails once it shut down
+
+	c, _ := testingConfig()
+	svr := newTestingServer(t, c)
+
+	if code, _ := probe(t, svr, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d before Start", code)
+	}
+	if code, _ := probe(t, svr, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d before Start", code)
+	}
+
+	if err := svr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, resp := probe(t, svr, "/readyz")
+		if code == http.StatusOK && resp.Status == "ok" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/readyz returned %d %+v after Start", code, resp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	svr.Shutdown(context.Background())
+	if code, resp := probe(t, svr, "/healthz"); code != http.StatusServiceUnavailable || resp.Status != "fail" {
+		t.Errorf("/healthz returned %d %+v after Shutdown", code, resp)
+	}
+}
+
+func TestReadyMemoryBudget(t *testing.T) {
+	// A heap over MemoryBudget makes /readyz fail its memory check
+
+	c, _ := testingConfig()
+	c.MemoryBudget = 1
+	svr := startTestingServer(t, c)
+
+	code, resp := probe(t, svr, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d over the memory budget", code)
+	}
+	for _, check := range resp.Checks {
+		if check.Name == "memory" && check.OK {
+			t.Error("Memory check passed over the budget")
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build cgo && !nozmq
+
+package main
+
+import (
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"strings"
+	"testing"
+	"time"
+)
+
+const benchBatchSize = 100
+
+func benchSocket(b *testing.B) *zmq.Socket {
+	// Sets up a PUSH socket to the server for benchmarking
+
+	socket, err := zmq.NewSocket(zmq.PUSH)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = socket.Connect(fmt.Sprintf("tcp://localhost:%s", zmqPort))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return socket
+}
+
+func messagesReceived(b *testing.B) int {
+	// Returns the number of messages the server has processed
+
+	js, err := getJson()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return int(js["messages_received"].(float64))
+}
+
+func waitForMessages(b *testing.B, count int) {
+	// Waits until the server has processed count messages
+
+	for messagesReceived(b) < count {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func benchLine(i int) string {
+	return fmt.Sprintf("INCR now bench.key%d %d", i%benchBatchSize, 1)
+}
+
+func BenchmarkIngestSingle(b *testing.B) {
+	// One line per ZMQ message
+
+	socket := benchSocket(b)
+	defer socket.Close()
+	start := messagesReceived(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := socket.Send(benchLine(i), 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+	waitForMessages(b, start+b.N)
+}
+
+func BenchmarkIngestBatch(b *testing.B) {
+	// Newline separated batches of lines in each ZMQ message
+
+	socket := benchSocket(b)
+	defer socket.Close()
+	start := messagesReceived(b)
+
+	b.ResetTimer()
+	lines := make([]string, 0, benchBatchSize)
+	for i := 0; i < b.N; i++ {
+		lines = append(lines, benchLine(i))
+		if len(lines) == benchBatchSize || i == b.N-1 {
+			if _, err := socket.Send(strings.Join(lines, "\n"), 0); err != nil {
+				b.Fatal(err)
+			}
+			lines = lines[:0]
+		}
+	}
+	waitForMessages(b, start+b.N)
+}
+
+func BenchmarkIngestMultipart(b *testing.B) {
+	// One line per part of multipart ZMQ messages
+
+	socket := benchSocket(b)
+	defer socket.Close()
+	start := messagesReceived(b)
+
+	b.ResetTimer()
+	parts := make([]interface{}, 0, benchBatchSize)
+	for i := 0; i < b.N; i++ {
+		parts = append(parts, benchLine(i))
+		if len(parts) == benchBatchSize || i == b.N-1 {
+			if _, err := socket.SendMessage(parts...); err != nil {
+				b.Fatal(err)
+			}
+			parts = parts[:0]
+		}
+	}
+	waitForMessages(b, start+b.N)
+}
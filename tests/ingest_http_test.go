@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+type ingestResponse struct {
+	Accepted int
+	Rejected int
+	Results  []tas.IngestResult
+}
+
+func postIngest(t *testing.T, contentType, body string) ingestResponse {
+	// POSTs body to http://localhost:{http_port}/INGEST and returns the
+	// decoded response
+
+	resp, err := http.Post(find_link("INGEST"), contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /INGEST returned %s", resp.Status)
+	}
+	var response ingestResponse
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func checkResults(t *testing.T, response ingestResponse, expected []tas.IngestResult) {
+	// Checks the line, outcome and reason of every result
+
+	accepted := 0
+	for _, result := range expected {
+		if result.OK {
+			accepted++
+		}
+	}
+	if response.Accepted != accepted || response.Rejected != len(expected)-accepted {
+		t.Errorf("%d accepted and %d rejected instead of %d and %d", response.Accepted, response.Rejected, accepted, len(expected)-accepted)
+	}
+	if len(response.Results) != len(expected) {
+		t.Fatalf("%d results instead of %d: %+v", len(response.Results), len(expected), response.Results)
+	}
+	for i, result := range response.Results {
+		e := expected[i]
+		if result.Line != e.Line || result.OK != e.OK || result.Reason != e.Reason || result.OK != (result.Error == "") {
+			t.Errorf("Result %+v instead of %+v", result, e)
+		}
+	}
+}
+
+func TestIngestJSON(t *testing.T) {
+	// Every element of a JSON array is accepted or rejected on its own
+
+	now := time.Now().Unix()
+	body := fmt.Sprintf(`[
+		{"verb": "INCR", "timestamp": %d, "key": "ingest.json.count", "value": 2},
+		{"verb": "INCR", "key": "ingest.json.count", "value": "two"},
+		"INCR now ingest.json.count 1",
+		{"verb": "APPEND", "timestamp": "now", "key": "ingest.json.list", "value": [1, 2]},
+		{"verb": "DECR", "key": "ingest.json.count", "value": 1},
+		{"verb": "INCR", "timestamp": "yesterday", "key": "ingest.json.count", "value": 1}
+	]`, now)
+	checkResults(t, postIngest(t, "application/json", body), []tas.IngestResult{
+		{Line: 1, OK: true},
+		{Line: 2, Reason: tas.ReasonBadValue},
+		{Line: 3, Reason: tas.ReasonMalformed},
+		{Line: 4, OK: true},
+		{Line: 5, Reason: tas.ReasonBadVerb},
+		{Line: 6, Reason: tas.ReasonBadTimestamp},
+	})
+
+	data, _ := ReadGetServer("ingest.json.count", t)
+	if data["ingest.json.count"] != 2.0 {
+		t.Errorf("ingest.json.count is %v instead of 2", data["ingest.json.count"])
+	}
+}
+
+func TestIngestLines(t *testing.T) {
+	// Lines of a batch are numbered as sent, skipping the empty ones
+
+	body := "INCR now ingest.lines 1\r\n\nNOPE now ingest.lines 1\nINCR now ingest.lines 1\n"
+	checkResults(t, postIngest(t, "text/plain", body), []tas.IngestResult{
+		{Line: 1, OK: true},
+		{Line: 3, Reason: tas.ReasonBadVerb},
+		{Line: 4, OK: true},
+	})
+}
+
+func TestIngestRequests(t *testing.T) {
+	// Requests other than a POST with a body within the limit are refused
+
+	resp, err := http.Get(find_link("INGEST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /INGEST returned %s", resp.Status)
+	}
+
+	for body, status := range map[string]int{
+		strings.Repeat("INCR now ingest.limit 1\n", 3000): http.StatusRequestEntityTooLarge,
+		`[{"verb": "INCR"`: http.StatusBadRequest,
+	} {
+		resp, err := http.Post(find_link("INGEST"), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("POST of %d bytes returned %s instead of %d", len(body), resp.Status, status)
+		}
+	}
+}
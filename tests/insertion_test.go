@@ -1,99 +1,19 @@
+//go:build cgo && !nozmq
+
 package main
 
 import (
 	"fmt"
-	zmq "github.com/pebbe/zmq3"
-	"log"
+	zmq "github.com/pebbe/zmq4"
 	"time"
 	//"strings"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"regexp"
 	"strconv"
 	"testing"
 )
 
-import (
-	"github.com/chango/tas/tas"
-)
-
-const http_port = 7451
 const tcp_port = 7450
 
-func find_link(key string) string {
-	return "http://localhost:" + strconv.Itoa(http_port) + "/" + key
-}
-
-func NewTestingServer() *tas.TASServer {
-	c := tas.NewDefaultTASConfig()
-	svr, err := tas.NewTASServer(c)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return svr
-}
-
-func TestMain(m *testing.M) {
-	svr := NewTestingServer()
-	go svr.Run()
-}
-
-func ReadDiagServer(t *testing.T) (map[string]interface{}, interface{}) {
-	// Get the output from http://localhost:{tcp_port}/DIAG
-
-	// HTTP GET the /DIAG page
-	link := find_link("DIAG")
-	resp, err := http.Get(link)
-
-	if err != nil {
-		t.Error(err)
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	// Read and return the output of HTTP GET
-	contents, _ := ioutil.ReadAll(resp.Body)
-	data := make(map[string]interface{})
-	json.Unmarshal(contents, &data)
-
-	return data, nil
-}
-
-func ReadGetServer(key string, t *testing.T) (map[string]interface{}, interface{}) {
-	// Get the output from http://localhost:{tcp_port}/GET?key={key}
-
-	// HTTP GET the /GET page
-	link := find_link("GET?key=" + key)
-	resp, err := http.Get(link)
-	defer resp.Body.Close()
-
-	if err != nil {
-		t.Error(err)
-		return nil, err
-	}
-
-	// Read and return the output of HTTP GET
-	contents, _ := ioutil.ReadAll(resp.Body)
-	data := make(map[string]interface{})
-
-	// When there is NO wild card in the key string, data[key] = value
-	// ie/ data["cart.grocery.vegetables.basket"] = 14
-	// When there is wild card in the key string, data is the hash map
-	// ie/ data = map[cart:map[grocery:map[vegetables:map[basket:14]]]]
-	var wildcard = regexp.MustCompile(`[\*.]*\*`)
-	if !wildcard.MatchString(key) {
-		var value interface{}
-		json.Unmarshal(contents, &value)
-		data[key] = value
-
-	} else {
-		json.Unmarshal(contents, &data)
-	}
-
-	return data, nil
-}
-
 func WaitForEmptyTree(t *testing.T) {
 	// Wait until the tree is empty using the garbage collector
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func lifecycleServer(t *testing.T, httpPort string) (*tas.TASServer, *tas.ChanTransport) {
+	// Returns a server that only receives messages from an in-process
+	// transport, next to the one of TestMain
+
+	c, transport := testingConfig()
+	c.HTTPPort = httpPort
+	svr, err := tas.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svr, transport
+}
+
+func TestShutdown(t *testing.T) {
+	// Shutdown stops ingestion and the HTTP server and waits for them
+
+	svr, transport := lifecycleServer(t, "7461")
+	if err := svr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	results, err := transport.Send([]byte("INCR now lifecycle.key 1"))
+	if err != nil || len(results) != 1 || !results[0].OK {
+		t.Fatalf("Message not accepted: %v %v", results, err)
+	}
+	resp, err := http.Get("http://localhost:7461/GET?key=lifecycle.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = svr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = transport.Send([]byte("INCR now lifecycle.key 1")); err != tas.ErrTransportClosed {
+		t.Errorf("Send after shutdown returned %v", err)
+	}
+	if _, err = http.Get("http://localhost:7461/GET?key=lifecycle.key"); err == nil {
+		t.Error("HTTP server still running after shutdown")
+	}
+	if err = svr.Start(context.Background()); err != tas.ErrServerClosed {
+		t.Errorf("Start after shutdown returned %v", err)
+	}
+	if err = svr.Shutdown(ctx); err != nil {
+		t.Errorf("Second shutdown returned %v", err)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	// The server shuts down when the context given to Start is done
+
+	svr, transport := lifecycleServer(t, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := svr.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := transport.Send([]byte("INCR now lifecycle.key 1"))
+		if err == tas.ErrTransportClosed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Server still running after its context was cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownUnstarted(t *testing.T) {
+	// A server that was never started releases its sockets on shutdown
+
+	svr, _ := lifecycleServer(t, "7462")
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	svr, _ = lifecycleServer(t, "7462")
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+// Buffer that the server's goroutines can log to concurrently
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Returns the records logged with the given message
+func (b *logBuffer) records(msg string) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		var record map[string]interface{}
+		if json.Unmarshal([]byte(line), &record) == nil && record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestLoggingRejectedMessages(t *testing.T) {
+	// Rejected messages are logged at debug level with their reason, and
+	// only the first ones of every second are logged
+
+	var out logBuffer
+	c, transport := testingConfig()
+	c.Logger = slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c.LogSampleFirst = 2
+	c.LogSampleThereafter = 0
+	startTestingServer(t, c)
+
+	transport.Send([]byte("NOPE now logging.a 1"))
+	records := out.records("Rejected message")
+	if len(records) != 1 {
+		t.Fatalf("Logged %d rejected messages instead of 1", len(records))
+	}
+	if records[0]["level"] != "DEBUG" || records[0]["reason"] != tas.ReasonBadVerb || records[0]["message"] != "NOPE now logging.a 1" {
+		t.Errorf("Logged %v", records[0])
+	}
+
+	for i := 0; i < 10; i++ {
+		transport.Send([]byte("NOPE now logging.a 1"))
+	}
+	// The second may change while sending, which allows 2 more records
+	if n := len(out.records("Rejected message")); n < 2 || n > 4 {
+		t.Errorf("Logged %d rejected messages with sampling", n)
+	}
+}
+
+func TestLoggingInvalid(t *testing.T) {
+	// Unknown log levels and formats are refused
+
+	c := tas.NewDefaultTASConfig()
+	c.LogLevel = "verbose"
+	if err := c.Validate(); err == nil {
+		t.Error("LogLevel verbose accepted")
+	}
+
+	c = tas.NewDefaultTASConfig()
+	c.LogFormat = "xml"
+	if err := c.Validate(); err == nil {
+		t.Error("LogFormat xml accepted")
+	}
+}
+
+// Transport that keeps serving after it is closed, until released
+type stuckTransport struct {
+	release chan struct{}
+}
+
+func (s *stuckTransport) Serve(handle tas.FrameHandler) error {
+	<-s.release
+	return nil
+}
+
+func (s *stuckTransport) Close() error {
+	return nil
+}
+
+func openFiles(t *testing.T, path string) int {
+	// Returns the number of descriptors of the process open on path
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("Open files are not listed in /proc:", err)
+	}
+	n := 0
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLoggingFileAfterTimeout(t *testing.T) {
+	// When Shutdown times out, the log file stays open for the goroutines
+	// still running, and is closed once they exit
+
+	path := filepath.Join(t.TempDir(), "tas.log")
+	stuck := &stuckTransport{release: make(chan struct{})}
+	c, _ := testingConfig()
+	c.LogOutput = path
+	c.Transports = append(c.Transports, stuck)
+	svr := startTestingServer(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := svr.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v instead of timing out", err)
+	}
+	if n := openFiles(t, path); n != 1 {
+		t.Errorf("Log file open %d times after Shutdown timed out", n)
+	}
+
+	close(stuck.release)
+	for i := 0; openFiles(t, path) != 0; i++ {
+		if i == 100 {
+			t.Fatal("Log file still open after the server stopped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if log, _ := os.ReadFile(path); !strings.Contains(string(log), "Server stopped") {
+		t.Errorf("Log file has no record of the server stopping:\n%s", log)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+const http_port = 7451
+
+func find_link(key string) string {
+	return "http://localhost:" + strconv.Itoa(http_port) + "/" + key
+}
+
+// The server the tests run against
+var testingServer *tas.TASServer
+
+// In-process transport of the testing server
+var testingTransport = tas.NewChanTransport()
+
+func NewTestingServer() *tas.TASServer {
+	c := tas.NewDefaultTASConfig()
+	c.Transports = []tas.Transport{testingTransport}
+	c.MaxPastSkew = time.Hour
+	c.MaxFutureSkew = time.Hour
+	c.HTTPIngestMaxBytes = 1 << 16
+	c.StatsDPort = "0"
+	c.StatsDAddress = "localhost"
+	c.StatsDPrefix = "statsd"
+	c.GraphitePort = "0"
+	c.GraphiteAddress = "localhost"
+	c.GraphiteRules = []tas.GraphiteRule{
+		{Prefix: "servers", Mode: tas.GraphiteSum},
+		{Prefix: "servers.db", Mode: tas.GraphiteGauge},
+	}
+	c.GraphiteMaxLineBytes = 256
+	c.GraphiteIdleTimeout = 500 * time.Millisecond
+	c.GraphiteMaxConnections = 2
+	svr, err := tas.NewTASServer(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return svr
+}
+
+func testingConfig() (*tas.TASConfig, *tas.ChanTransport) {
+	// Returns the configuration of a server that receives messages from an
+	// in-process transport only and serves HTTP through its Handler, so that
+	// it runs next to the one of TestMain
+
+	transport := tas.NewChanTransport()
+	c := tas.NewDefaultTASConfig()
+	c.ZMQPort = ""
+	c.HTTPPort = ""
+	c.Transports = []tas.Transport{transport}
+	return c, transport
+}
+
+func newTestingServer(t *testing.T, c *tas.TASConfig) *tas.TASServer {
+	// Returns a server with configuration c, shut down when the test ends
+
+	svr, err := tas.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svr.Shutdown(context.Background()) })
+	return svr
+}
+
+func startTestingServer(t *testing.T, c *tas.TASConfig) *tas.TASServer {
+	// Returns a started server with configuration c, shut down when the
+	// test ends
+
+	svr := newTestingServer(t, c)
+	if err := svr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return svr
+}
+
+func serve(svr *tas.TASServer, r *http.Request) *httptest.ResponseRecorder {
+	// Serves a request with the server's handler
+
+	w := httptest.NewRecorder()
+	svr.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func serveJSON(t *testing.T, svr *tas.TASServer, r *http.Request, v interface{}) int {
+	// Serves a request with the server's handler, decodes the JSON response
+	// into v and returns its status code
+
+	w := serve(svr, r)
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("%s %s has Content-Type %q", r.Method, r.URL, w.Header().Get("Content-Type"))
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s %s returned %q: %v", r.Method, r.URL, w.Body.String(), err)
+	}
+	return w.Code
+}
+
+func TestMain(m *testing.M) {
+	// The tests share a server on the default ports, which receives over
+	// ZMQ in builds with ZMQ and over testingTransport in all builds
+
+	testingServer = NewTestingServer()
+	go testingServer.Run()
+	// Wait for the HTTP server to listen
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(find_link("DIAG")); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	os.Exit(m.Run())
+}
+
+func ReadDiagServer(t *testing.T) (map[string]interface{}, interface{}) {
+	// Get the output from http://localhost:{tcp_port}/DIAG
+
+	// HTTP GET the /DIAG page
+	link := find_link("DIAG")
+	resp, err := http.Get(link)
+
+	if err != nil {
+		t.Error(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read and return the output of HTTP GET
+	contents, _ := ioutil.ReadAll(resp.Body)
+	data := make(map[string]interface{})
+	json.Unmarshal(contents, &data)
+
+	return data, nil
+}
+
+func ReadGetServer(key string, t *testing.T) (map[string]interface{}, interface{}) {
+	// Get the output from http://localhost:{tcp_port}/GET?key={key}
+
+	// HTTP GET the /GET page
+	link := find_link("GET?key=" + key)
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Error(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read and return the output of HTTP GET
+	contents, _ := ioutil.ReadAll(resp.Body)
+	data := make(map[string]interface{})
+
+	// When there is NO wild card in the key string, data[key] = value
+	// ie/ data["cart.grocery.vegetables.basket"] = 14
+	// When there is wild card in the key string, data is the hash map
+	// ie/ data = map[cart:map[grocery:map[vegetables:map[basket:14]]]]
+	var wildcard = regexp.MustCompile(`[\*.]*\*`)
+	if !wildcard.MatchString(key) {
+		var value interface{}
+		json.Unmarshal(contents, &value)
+		data[key] = value
+
+	} else {
+		json.Unmarshal(contents, &data)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	// /metrics counts messages by verb and reason in the Prometheus format
+
+	c, transport := testingConfig()
+	svr := startTestingServer(t, c)
+
+	transport.Send([]byte("INCR now metrics.a 1\nINCR now metrics.a 2\nAPPEND now metrics.a [1]\nNOPE now metrics.b 1"))
+
+	// Make sure an HTTP request has been measured
+	serve(svr, httptest.NewRequest("GET", "/DIAG", nil))
+	w := serve(svr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type is %q", w.Header().Get("Content-Type"))
+	}
+	metrics := w.Body.String()
+
+	for _, line := range []string{
+		`tas_messages_received_total{verb="INCR"} 2`,
+		`tas_messages_accepted_total{verb="INCR"} 2`,
+		`tas_messages_rejected_total{verb="APPEND",reason="type_conflict"} 1`,
+		`tas_messages_rejected_total{verb="unknown",reason="bad_verb"} 1`,
+		`tas_ingest_duration_seconds_count 3`,
+		`tas_tree_leafs 1`,
+		"# TYPE tas_http_request_duration_seconds histogram",
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Metrics have no line %s", line)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !cgo || nozmq
+
+package main
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func TestDefaultConfigWithoutZMQ(t *testing.T) {
+	// The default configuration, which the testing server runs with, has no
+	// ZMQ port in builds without ZMQ, and configuring one fails
+
+	c := tas.NewDefaultTASConfig()
+	if c.ZMQPort != "" {
+		t.Errorf("Default ZMQPort is %q in a build without ZMQ", c.ZMQPort)
+	}
+	c.ZMQPort = "7450"
+	if _, err := tas.NewTASServer(c); err != tas.ErrNoZMQ {
+		t.Errorf("ZMQPort accepted in a build without ZMQ: %v", err)
+	}
+}
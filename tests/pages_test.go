@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/chango/tas/tas"
+	"github.com/chango/tas/tree"
+)
+
+func TestPagesEmbedded(t *testing.T) {
+	// The pages work from any working directory
+
+	c, _ := testingConfig()
+	c.HTTPPrefix = "/tas"
+	svr := newTestingServer(t, c)
+
+	for path, content := range map[string]string{
+		"/tas/":               "TAS Navigation Page",
+		"/tas/TREE":           `src="static/tree.js"`,
+		"/tas/STATS":          `src="static/stats.js"`,
+		"/tas/static/tree.js": "d3.layout.tree()",
+	} {
+		w := serve(svr, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), content) {
+			t.Errorf("%s returned %d %q", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPagesOverride(t *testing.T) {
+	// Files in HTTPAssetsDir replace the embedded ones
+
+	dir, err := ioutil.TempDir("", "tas-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "static"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "main.html"), []byte("<h1>Our TAS</h1>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "static", "tree.css"), []byte(".node {}"), 0644)
+
+	c, _ := testingConfig()
+	c.HTTPAssetsDir = dir
+	svr := newTestingServer(t, c)
+
+	for path, content := range map[string]string{
+		"/":                "<h1>Our TAS</h1>",
+		"/static/tree.css": ".node {}",
+		"/static/tree.js":  "d3.layout.tree()",
+		"/TREE":            `src="static/tree.js"`,
+	} {
+		w := serve(svr, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), content) {
+			t.Errorf("%s returned %d %q", path, w.Code, w.Body.String())
+		}
+	}
+
+	c.HTTPAssetsDir = filepath.Join(dir, "missing")
+	if svr, err := tas.New(c); err == nil {
+		svr.Shutdown(context.Background())
+		t.Error("Missing HTTPAssetsDir accepted")
+	}
+}
+
+// Returns the JSON between start and end in a page
+func pageData(t *testing.T, page, start, end string) string {
+	i := strings.Index(page, start)
+	if i < 0 {
+		t.Fatalf("Page has no %q: %s", start, page)
+	}
+	data := page[i+len(start):]
+	return data[:strings.Index(data, end)]
+}
+
+// Adds the names of a node of the TREE page and its descendants to names
+func treeNames(node map[string]interface{}, names map[string]bool) {
+	names[node["name"].(string)] = true
+	children, _ := node["children"].([]interface{})
+	for _, child := range children {
+		treeNames(child.(map[string]interface{}), names)
+	}
+}
+
+func TestPagesHostileKeys(t *testing.T) {
+	// Keys with quotes, template actions or markup are data, not code
+
+	c, transport := testingConfig()
+	svr := startTestingServer(t, c)
+
+	hostile := []string{`"quote`, `{{printf}}`, `</script><script>alert(1)</script>`, `{{template`, `'\\`}
+	var batch []string
+	for _, key := range hostile {
+		batch = append(batch, "INCR now hostile."+key+" 1")
+	}
+	transport.Send([]byte(strings.Join(batch, "\n")))
+
+	w := serve(svr, httptest.NewRequest("GET", "/TREE", nil))
+	page := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("/TREE returned %d %q", w.Code, page)
+	}
+	if strings.Contains(page, "<script>alert(1)") {
+		t.Error("/TREE contains the markup of a key")
+	}
+	var root []map[string]interface{}
+	if err := json.Unmarshal([]byte(pageData(t, page, "var treeData = ", ";")), &root); err != nil || len(root) != 1 {
+		t.Fatalf("/TREE data is not valid JSON: %v", err)
+	}
+	names := make(map[string]bool)
+	treeNames(root[0], names)
+	for _, key := range hostile {
+		if !names[key] {
+			t.Errorf("/TREE has no node %q", key)
+		}
+	}
+
+	w = serve(svr, httptest.NewRequest("GET", "/STATS", nil))
+	page = w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("/STATS returned %d %q", w.Code, page)
+	}
+	var counts []struct {
+		Timestamp float64
+		Count     int
+	}
+	if err := json.Unmarshal([]byte(pageData(t, page, "var ts_counts = ", ";")), &counts); err != nil {
+		t.Fatalf("/STATS data is not valid JSON: %v", err)
+	}
+	total := 0
+	for _, count := range counts {
+		total += count.Count
+	}
+	if total != len(hostile) {
+		t.Errorf("/STATS counts %d nodes instead of %d", total, len(hostile))
+	}
+}
+
+func TestTreePrinterHostileKeys(t *testing.T) {
+	// TreePrinter and TSCounters return valid JSON whatever the keys are
+
+	data := tree.MakeTree()
+	data.AddData(`a."b`, 1, "1404148628")
+	data.AddData(`a.{{end}}\`, []interface{}{`"x"`}, "1404148629")
+
+	var root map[string]interface{}
+	if err := json.Unmarshal([]byte(tas.TreePrinter(data.DataNode)), &root); err != nil {
+		t.Fatalf("TreePrinter returned invalid JSON: %v", err)
+	}
+	names := make(map[string]bool)
+	treeNames(root, names)
+	if !names[`"b`] || !names[`{{end}}\`] {
+		t.Errorf("TreePrinter lost keys: %v", names)
+	}
+
+	var counts []map[string]interface{}
+	if err := json.Unmarshal([]byte("["+tas.TSCounters(data.Timestamps())+"]"), &counts); err != nil || len(counts) != 2 {
+		t.Errorf("TSCounters returned %q: %v", tas.TSCounters(data.Timestamps()), err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func TestReload(t *testing.T) {
+	// Live settings are applied, the others are reported
+
+	c, transport := testingConfig()
+	c.ReloadConfig = func() (*tas.TASConfig, error) {
+		reloaded := tas.NewDefaultTASConfig()
+		reloaded.ZMQPort = ""
+		reloaded.HTTPPort = "7463"
+		reloaded.MaxPastSkew = time.Hour
+		return reloaded, nil
+	}
+	svr := startTestingServer(t, c)
+
+	old := "INCR 1404148628 reload.key 1"
+	if results, _ := transport.Send([]byte(old)); !results[0].OK {
+		t.Fatalf("Old message rejected before reload: %v", results)
+	}
+
+	result, err := svr.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Applied, []string{"max_past_skew"}) {
+		t.Errorf("Applied %v instead of max_past_skew", result.Applied)
+	}
+	if !reflect.DeepEqual(result.RestartRequired, []string{"http_port"}) {
+		t.Errorf("Restart required for %v instead of http_port", result.RestartRequired)
+	}
+
+	results, err := transport.Send([]byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].OK || results[0].Reason != tas.ReasonTooOld {
+		t.Errorf("Old message not rejected after reload: %v", results)
+	}
+}
+
+func TestReloadDisabled(t *testing.T) {
+	// Reload fails without a ReloadConfig
+
+	c, _ := testingConfig()
+	svr := newTestingServer(t, c)
+	if _, err := svr.Reload(); err != tas.ErrNoReload {
+		t.Errorf("Reload returned %v", err)
+	}
+}
+
+func TestReloadScope(t *testing.T) {
+	// Reloading and ingesting over HTTP need admin credentials
+
+	c, _ := testingConfig()
+	c.HTTPCredentials = []tas.HTTPCredential{
+		{Token: "read-token", Scope: tas.ScopeRead},
+		{Token: "admin-token", Scope: tas.ScopeAdmin},
+	}
+	c.ReloadConfig = func() (*tas.TASConfig, error) {
+		reloaded, _ := testingConfig()
+		reloaded.HTTPCredentials = c.HTTPCredentials
+		return reloaded, nil
+	}
+	svr := startTestingServer(t, c)
+
+	for _, test := range []struct {
+		token   string
+		allowed int
+	}{
+		{"", 401},
+		{"read-token", 403},
+		{"admin-token", 200},
+	} {
+		for _, r := range []*http.Request{
+			httptest.NewRequest("POST", "/RELOAD", nil),
+			httptest.NewRequest("POST", "/INGEST", strings.NewReader("INCR now reload.scope 1")),
+		} {
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if w := serve(svr, r); w.Code != test.allowed {
+				t.Errorf("%s with %q returned %d instead of %d", r.URL.Path, test.token, w.Code, test.allowed)
+			}
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/GET?key=reload.scope", nil)
+	r.Header.Set("Authorization", "Bearer read-token")
+	if w := serve(svr, r); w.Code != 200 || w.Body.String() != "1" {
+		t.Errorf("/GET with the read token returned %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReloadInjectedLogger(t *testing.T) {
+	// The level of a Logger passed in the configuration is not changed by
+	// a reload
+
+	c, _ := testingConfig()
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.ReloadConfig = func() (*tas.TASConfig, error) {
+		reloaded, _ := testingConfig()
+		reloaded.LogLevel = tas.LogDebug
+		return reloaded, nil
+	}
+	svr := startTestingServer(t, c)
+
+	result, err := svr.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || !reflect.DeepEqual(result.RestartRequired, []string{"log_level"}) {
+		t.Errorf("Reload returned %+v instead of log_level to restart", result)
+	}
+}
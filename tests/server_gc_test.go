@@ -1,9 +1,11 @@
+//go:build cgo && !nozmq
+
 package main
 
 import (
 	"encoding/json"
 	"fmt"
-	zmq "github.com/pebbe/zmq3"
+	zmq "github.com/pebbe/zmq4"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -79,9 +81,9 @@ func TestServerRecievingData(t *testing.T) {
 	errorCheck(err, "Error setting up socket", t)
 	defer socket.Close()
 
-	now := time.Now().Unix()
 	// Incase there is input in the tree
 	tearDown()
+	now := time.Now().Unix()
 	msg := fmt.Sprintf("INCR %s %s %d", strconv.FormatInt(now, 10), "test.tes.te.t", 5)
 	_, err_send := socket.SendBytes([]byte(msg), 0)
 
@@ -125,7 +127,7 @@ func TestGcWorking(t *testing.T) {
 	//Add data
 	for count := 0; count < 10; count++ {
 		now := time.Now().Unix() - 60
-		msg := fmt.Sprintf("INCR %s %s %d", strconv.FormatInt(now, 10), "test.tes.te.t"+string(count), 5)
+		msg := fmt.Sprintf("INCR %s %s %d", strconv.FormatInt(now, 10), "test.tes.te.t"+strconv.Itoa(count), 5)
 		_, err_send := socket.SendBytes([]byte(msg), 0)
 		errorCheck(err_send, "Could not send input to server", t)
 
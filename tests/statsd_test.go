@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func sendStatsD(t *testing.T, lines ...string) {
+	// Sends lines to the StatsD listener of the testing server in one
+	// datagram, then waits until the last one, which must be invalid, was
+	// rejected
+
+	conn, err := net.Dial("udp", testingServer.StatsDAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	waitForRejected(t, lines[len(lines)-1])
+}
+
+func TestStatsD(t *testing.T) {
+	// Every StatsD metric type is stored with its TAS verb
+
+	// Send the counters within one bucket, for /GET to return their sum
+	if ns := time.Now().Nanosecond(); ns > 800*int(time.Millisecond) {
+		time.Sleep(time.Second - time.Duration(ns))
+	}
+	rejected := []struct {
+		line   string
+		reason string
+	}{
+		{"bad:1|x", tas.ReasonBadVerb},
+		{"bad:1|c|@2", tas.ReasonBadValue},
+		{"bad:many|c", tas.ReasonBadValue},
+		{"bad:10000000000000000|c", tas.ReasonBadValue},
+		{"bad:1000000000000000|c|@0.01", tas.ReasonBadValue},
+	}
+	lines := []string{
+		"hits:3|c",
+		"hits:1|c|@0.5",
+		"hits:1|c|#region:eu",
+		"temperature:10|g",
+		"temperature:+5|g",
+		"temperature:-3|g",
+		"fresh:-2|g",
+		"latency:12.5|ms",
+		"latency:7|h",
+		"users:alice|s",
+		"users:bob|s",
+	}
+	for _, r := range rejected {
+		lines = append(lines, r.line)
+	}
+	sendStatsD(t, lines...)
+
+	for key, expected := range map[string]float64{"statsd.hits": 6, "statsd.temperature": 12, "statsd.fresh": -2} {
+		data, _ := ReadGetServer(key, t)
+		if data[key] != expected {
+			t.Errorf("%s is %v instead of %v", key, data[key], expected)
+		}
+	}
+	for key, expected := range map[string][]string{
+		"statsd.latency": {"12.5", "7"},
+		"statsd.users":   {"alice", "bob"},
+	} {
+		data, _ := ReadGetServer(key, t)
+		values, _ := data[key].([]interface{})
+		var members []string
+		for _, v := range values {
+			returnVal, _ := json.Marshal(v)
+			members = append(members, strings.Trim(string(returnVal), `"`))
+		}
+		sort.Strings(members)
+		if !reflect.DeepEqual(members, expected) {
+			t.Errorf("%s is %v instead of %v", key, members, expected)
+		}
+	}
+	if data, _ := ReadGetServer("statsd.bad", t); data["statsd.bad"] != nil {
+		t.Errorf("Invalid lines stored as %v", data["statsd.bad"])
+	}
+
+	letters := readDeadLetters(t)
+	for i, r := range rejected {
+		letter := letters.Messages[len(rejected)-1-i]
+		if letter.Message != r.line || letter.Reason != r.reason {
+			t.Errorf("Dead letter %+v instead of %q rejected as %s", letter, r.line, r.reason)
+		}
+	}
+}
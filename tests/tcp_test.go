@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func serveTCP(t *testing.T) (*tas.TCPTransport, chan string) {
+	// Returns a TCP transport with low limits that passes the frames it
+	// receives to the returned channel
+
+	transport, err := tas.NewTCPTransport("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.MaxLineBytes = 256
+	transport.IdleTimeout = 500 * time.Millisecond
+	transport.MaxConnections = 2
+	frames := make(chan string, 100)
+	go transport.Serve(func(frame []byte) []tas.IngestResult {
+		frames <- string(frame)
+		return nil
+	})
+	return transport, frames
+}
+
+func dialTCP(t *testing.T, transport *tas.TCPTransport) net.Conn {
+	// Connects to a TCP transport
+
+	conn, err := net.Dial("tcp", transport.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func receiveFrame(t *testing.T, frames chan string, expected string) {
+	// Fails unless expected is the next frame handled
+
+	select {
+	case frame := <-frames:
+		if frame != expected {
+			t.Errorf("Received %q instead of %q", frame, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q not received", expected)
+	}
+}
+
+func TestTCPLines(t *testing.T) {
+	// Every non-empty line is a frame, and the lines and bytes are counted
+
+	transport, frames := serveTCP(t)
+	defer transport.Close()
+	conn := dialTCP(t, transport)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "INCR now tcp.lines 1\n\n  INCR now tcp.lines 2  \nINCR now tcp.lines 3\n")
+	receiveFrame(t, frames, "INCR now tcp.lines 1")
+	receiveFrame(t, frames, "INCR now tcp.lines 2")
+	receiveFrame(t, frames, "INCR now tcp.lines 3")
+
+	stats := transport.Stats()
+	if stats.Lines != 4 || stats.Bytes != 68 || stats.OpenConnections != 1 || stats.TotalConnections != 1 {
+		t.Errorf("Stats are %+v after 4 lines of 68 bytes", stats)
+	}
+}
+
+func TestTCPLimits(t *testing.T) {
+	// Connections that go idle or send a line over the limit are closed,
+	// and connections over the limit are refused
+
+	transport, frames := serveTCP(t)
+	defer transport.Close()
+
+	idle := dialTCP(t, transport)
+	defer idle.Close()
+	// Traffic before the timeout keeps the connection open, even in the
+	// middle of a line
+	for _, part := range []string{"INCR now ", "tcp.idle ", "1\n"} {
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprint(idle, part)
+	}
+	receiveFrame(t, frames, "INCR now tcp.idle 1")
+	long := dialTCP(t, transport)
+	defer long.Close()
+	// Make sure the transport serves both connections before the third one
+	fmt.Fprintln(long, "INCR now tcp.long 1")
+	receiveFrame(t, frames, "INCR now tcp.long 1")
+	refused := dialTCP(t, transport)
+	defer refused.Close()
+
+	if !closedByServer(refused, time.Second) {
+		t.Error("Connection over the limit not refused")
+	}
+	// A long line is refused even when it comes in small reads
+	fmt.Fprint(long, "INCR now tcp.long "+strings.Repeat("1", 200))
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintln(long, strings.Repeat("1", 100))
+	if !closedByServer(long, time.Second) {
+		t.Error("Connection that sent a line over the limit not closed")
+	}
+	if !closedByServer(idle, 2*time.Second) {
+		t.Error("Idle connection not closed")
+	}
+
+	stats := transport.Stats()
+	if stats.RefusedConnections != 1 || stats.LinesTooLong != 1 || stats.IdleTimeouts != 1 || stats.OpenConnections != 0 || stats.TotalConnections != 2 {
+		t.Errorf("Stats are %+v after a refused, a long and an idle connection", stats)
+	}
+	select {
+	case frame := <-frames:
+		t.Errorf("Received %q over the limits", frame)
+	default:
+	}
+}
+
+func TestTCPBinaryFrame(t *testing.T) {
+	// A binary frame over TCP is refused and closes the connection
+
+	transport, frames := serveTCP(t)
+	defer transport.Close()
+	conn := dialTCP(t, transport)
+	defer conn.Close()
+
+	frame, _ := tas.EncodeBinary(binaryTestMessages())
+	conn.Write(append(frame, '\n'))
+	if !closedByServer(conn, time.Second) {
+		t.Error("Connection not closed after a binary frame")
+	}
+	if stats := transport.Stats(); stats.BinaryFrames != 1 || stats.Lines != 1 {
+		t.Errorf("Stats are %+v after a binary frame", stats)
+	}
+	select {
+	case frame := <-frames:
+		t.Errorf("Received %q from a binary frame", frame)
+	default:
+	}
+}
+
+func TestTCPAck(t *testing.T) {
+	// Every line gets one reply line in the format of the ZMQ acknowledged
+	// receiver, whatever the error of a rejected message contains, and a
+	// binary frame gets an ERR reply before the connection is closed
+
+	transport, err := tas.NewTCPTransport("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	transport.Ack = true
+	go transport.Serve(func(frame []byte) []tas.IngestResult {
+		results, _ := testingTransport.Send(frame)
+		return results
+	})
+	conn := dialTCP(t, transport)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := bufio.NewReader(conn)
+
+	for _, test := range []struct {
+		line   string
+		reason string
+	}{
+		{"INCR now tcp.acked 1", ""},
+		{"INCR now tcp.acked x", tas.ReasonBadValue},
+		{`INCR now tcp.acked "1\n2"`, tas.ReasonBadValue},
+		{"UNKNOWN now tcp.acked 1", tas.ReasonBadVerb},
+		{`APPEND now tcp.appended {"a":`, tas.ReasonBadValue},
+		{"INCR now tcp.acked 2", ""},
+	} {
+		fmt.Fprintln(conn, test.line)
+		reply, err := replies.ReadString('\n')
+		if err != nil {
+			t.Fatalf("No reply to %q: %v", test.line, err)
+		}
+		reply = strings.TrimSuffix(reply, "\n")
+		if test.reason == "" {
+			if reply != "OK 1" {
+				t.Errorf("%q got %q instead of OK 1", test.line, reply)
+			}
+			continue
+		}
+		var resp struct {
+			Accepted, Rejected int
+			Results            []tas.IngestResult
+		}
+		if !strings.HasPrefix(reply, "ERR ") || json.Unmarshal([]byte(strings.TrimPrefix(reply, "ERR ")), &resp) != nil {
+			t.Errorf("%q got %q", test.line, reply)
+			continue
+		}
+		if resp.Accepted != 0 || resp.Rejected != 1 || len(resp.Results) != 1 || resp.Results[0].Reason != test.reason {
+			t.Errorf("%q got %+v instead of a %s rejection", test.line, resp, test.reason)
+		}
+	}
+
+	frame, _ := tas.EncodeBinary(binaryTestMessages())
+	conn.Write(append(frame, '\n'))
+	if reply, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(reply, "ERR {") || !strings.Contains(reply, tas.ReasonMalformed) {
+		t.Errorf("Binary frame got %q: %v", reply, err)
+	}
+	if _, err = replies.ReadString('\n'); err != io.EOF {
+		t.Errorf("Connection not closed after a binary frame: %v", err)
+	}
+}
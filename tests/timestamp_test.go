@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/chango/tas/tas"
+)
+
+func timestampsAdjusted(t *testing.T) map[string]interface{} {
+	// Returns the counts of adjusted timestamps from the /DIAG page
+
+	diag, err := ReadDiagServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adjusted, _ := diag["timestamps_adjusted"].(map[string]interface{})
+	return adjusted
+}
+
+func TestServerTimestamps(t *testing.T) {
+	// "now" and "-" are stamped by the server, timestamps outside the
+	// acceptance window of the testing server are rejected, and only the
+	// stored messages count as adjusted
+
+	before := timestampsAdjusted(t)
+	now := time.Now().Unix()
+	rejected := []struct {
+		message string
+		reason  string
+	}{
+		{"INCR now timestamp.conflict 1", tas.ReasonTypeConflict},
+		{fmt.Sprintf("INCR %d timestamp.old 1", now-7200), tas.ReasonTooOld},
+		{fmt.Sprintf("INCR %d timestamp.new 1", now+7200), tas.ReasonTooNew},
+	}
+	messages := []string{"APPEND now timestamp.conflict [1]", "INCR - timestamp.dash 1"}
+	for _, r := range rejected {
+		messages = append(messages, r.message)
+	}
+	letters := sendRejected(t, messages...)
+
+	for i, r := range rejected {
+		letter := letters.Messages[len(rejected)-1-i]
+		if letter.Message != r.message || letter.Reason != r.reason {
+			t.Errorf("Dead letter %+v instead of %q rejected as %s", letter, r.message, r.reason)
+		}
+	}
+	data, _ := ReadGetServer("timestamp.dash", t)
+	if data["timestamp.dash"] != 1.0 {
+		t.Errorf("Server stamped message stored as %v", data["timestamp.dash"])
+	}
+	after := timestampsAdjusted(t)
+	stamped, _ := after[tas.AdjustServerStamped].(float64)
+	stampedBefore, _ := before[tas.AdjustServerStamped].(float64)
+	if stamped-stampedBefore != 2 {
+		t.Errorf("%v more server stamped timestamps instead of 2", stamped-stampedBefore)
+	}
+}
+
+func TestTimestampUnits(t *testing.T) {
+	// Integer timestamps in seconds, milliseconds, microseconds and
+	// nanoseconds land in the one second bucket of the testing server
+
+	sec := time.Now().Unix() - 50
+	at := time.Unix(sec, 250*int64(time.Millisecond))
+	units := []struct {
+		key string
+		ts  int64
+	}{
+		{"s", sec},
+		{"ms", at.UnixMilli()},
+		{"us", at.UnixMicro()},
+		{"ns", at.UnixNano()},
+	}
+	var messages []string
+	for _, unit := range units {
+		messages = append(messages, fmt.Sprintf("INCR %d units.%s 1", unit.ts, unit.key))
+	}
+	sendRejected(t, append(messages, "NOPE now units.done 1")...)
+
+	for _, unit := range units {
+		for _, query := range []string{fmt.Sprint(sec), fmt.Sprintf("%d.25", sec), fmt.Sprint(at.UnixMilli())} {
+			link := fmt.Sprintf("%s?key=units.%s&t=%s", find_link("GET"), unit.key, query)
+			resp, err := http.Get(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "1" {
+				t.Errorf("%s returned %q", link, body)
+			}
+		}
+	}
+}
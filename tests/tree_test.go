@@ -2,10 +2,12 @@ package main
 
 import (
 	
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 	"strconv"
-	"../tree"
+	"github.com/chango/tas/tree"
 )
 
 func createAddDataTree(key string, val int) (*tree.Tree, string){
@@ -13,7 +15,7 @@ func createAddDataTree(key string, val int) (*tree.Tree, string){
 	//time stamp of the data
 	
 	pfdTree := tree.MakeTree()
-	now := string(time.Now().Unix())
+	now := strconv.FormatInt(time.Now().Unix(), 10)
 	pfdTree.AddData(key, val, now)
 	return pfdTree, now
 }
@@ -121,3 +123,147 @@ func TestGetOldestTS(t *testing.T) {
 		t.Error("Error with the oldest time stamp in the tree")
 	}
 }
+
+func TestParseTimestamp(t *testing.T) {
+	// Timestamp keys are parsed to Unix nanoseconds, refusing the ones that
+	// do not fit
+
+	cases := []struct {
+		key string
+		ts  int64
+		ok  bool
+	}{
+		{"1404148628", 1404148628000000000, true},
+		{"1404148628.25", 1404148628250000000, true},
+		{"1404148628.0000000001", 1404148628000000000, true},
+		{"-1.5", -1500000000, true},
+		{"-0.5", -500000000, true},
+		{"9223372036.854775807", 9223372036854775807, true},
+		{"9223372036.854775808", 0, false},
+		{"9223372037", 0, false},
+		{"-9223372037", 0, false},
+		{"1.x", 0, false},
+		{"yesterday", 0, false},
+	}
+	for _, c := range cases {
+		ts, err := tree.ParseTimestamp(c.key)
+		if c.ok && (err != nil || ts != c.ts) {
+			t.Errorf("%s parsed to %d, %v instead of %d", c.key, ts, err, c.ts)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s parsed to %d instead of failing", c.key, ts)
+		}
+	}
+}
+
+func TestAddDataInvalidTimestamp(t *testing.T) {
+	// Data with a timestamp that cannot be parsed is refused
+
+	pfdTree := tree.MakeTree()
+	for _, ts := range []string{"yesterday", "99999999999"} {
+		if err := pfdTree.AddData("test.tes", 5, ts); err == nil {
+			t.Errorf("Timestamp %s accepted", ts)
+		}
+	}
+	if pfdTree.GetNumLeafs() != 0 {
+		t.Error("Data with an invalid timestamp added to the tree")
+	}
+}
+
+func TestGCBeforeOrder(t *testing.T) {
+	// The GC compares timestamps as numbers, not as strings
+
+	pfdTree := tree.MakeTree()
+	for _, ts := range []string{"9", "9.5", "10", "11"} {
+		pfdTree.AddData("test."+ts, 5, ts)
+	}
+	if freed := pfdTree.GCBefore(10 * int64(time.Second)); freed != 2 {
+		t.Errorf("GC deleted %d leafs before 10 instead of 2", freed)
+	}
+	if pfdTree.GetOldestTS() != 10 || pfdTree.GetNumLeafs() != 2 {
+		t.Errorf("Oldest timestamp is %d with %d leafs after the GC", pfdTree.GetOldestTS(), pfdTree.GetNumLeafs())
+	}
+}
+
+func TestAddDataSameInstant(t *testing.T) {
+	// Every spelling of a timestamp ends up in the same timestamp node
+
+	pfdTree := tree.MakeTree()
+	for _, ts := range []string{"10", "10.0", "10.000000000"} {
+		pfdTree.AddData("test.tes", 5, ts)
+	}
+	timestamps := pfdTree.Timestamps()
+	if len(*timestamps) != 1 || (*timestamps)["10"] == nil {
+		t.Errorf("%d timestamp nodes for one instant", len(*timestamps))
+	}
+}
+
+func TestTreeConcurrency(t *testing.T) {
+	// Data is added, read and collected from several goroutines at once,
+	// which the race detector checks when the tests run with -race
+
+	pfdTree := tree.MakeTree()
+	start := time.Now().UnixNano()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("test.w%d.k%d", w, i%10)
+				pfdTree.AddDataAt(key, 1, start+int64(i)*int64(time.Millisecond))
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pfdTree.GetValue([]string{"test", "*", "k1"}, nil, 5)
+				pfdTree.GetNumLeafs()
+				pfdTree.GetOldestTS()
+				pfdTree.CheckGCRunning()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			pfdTree.GCBefore(start + int64(i)*int64(time.Millisecond))
+		}
+	}()
+	wg.Wait()
+
+	pfdTree.GCBefore(start + int64(time.Hour))
+	if pfdTree.GetNumLeafs() != 0 || len(*pfdTree.Timestamps()) != 0 {
+		t.Errorf("%d leafs and %d timestamps left after the GC", pfdTree.GetNumLeafs(), len(*pfdTree.Timestamps()))
+	}
+}
+
+func TestGaugeDelta(t *testing.T) {
+	// Changes to a gauge from several goroutines at once are not lost
+
+	pfdTree := tree.MakeTree()
+	ts := time.Now().UnixNano()
+	pfdTree.AddDataAt("test.gauge", tree.Gauge(10), ts-int64(time.Second))
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				pfdTree.AddDataAt("test.gauge", tree.GaugeDelta(1), ts)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value := pfdTree.GetValue([]string{"test", "gauge"}, nil, 5); value != 410.0 {
+		t.Errorf("Gauge is %v instead of 410", value)
+	}
+	if err := pfdTree.AddDataAt("test.gauge", 1, ts); err != tree.ErrTypeConflict {
+		t.Errorf("INCR of a gauge returned %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+//go:build cgo && !nozmq
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	zmq "github.com/pebbe/zmq4"
+)
+
+func TestZMQShutdown(t *testing.T) {
+	// Shutdown stops the ZMQ receivers while they wait for messages and
+	// releases their ports
+
+	c, _ := testingConfig()
+	c.ZMQPort = "7470"
+	c.ZMQAckPort = "7471"
+	svr := startTestingServer(t, c)
+
+	push, err := zmq.NewSocket(zmq.PUSH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer push.Close()
+	push.SetLinger(0)
+	if err = push.Connect("tcp://localhost:7470"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = push.Send("INCR now zmq.pushed 1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := zmq.NewSocket(zmq.REQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer req.Close()
+	req.SetLinger(0)
+	req.SetRcvtimeo(5 * time.Second)
+	if err = req.Connect("tcp://localhost:7471"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = req.Send("INCR now zmq.acked 1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := req.Recv(0); err != nil || reply != "OK 1" {
+		t.Fatalf("Acknowledged receiver replied %q: %v", reply, err)
+	}
+	if _, err = req.Send("INCR now zmq.acked x", 0); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := req.Recv(0); err != nil || !strings.HasPrefix(reply, `ERR {"accepted":0,"rejected":1,`) {
+		t.Fatalf("Acknowledged receiver replied %q to a rejected message: %v", reply, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(serve(svr, httptest.NewRequest("GET", "/GET?key=zmq.pushed", nil)).Body.String(), "1") {
+		if time.Now().After(deadline) {
+			t.Fatal("Pushed message not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = svr.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+
+	// The ports can be bound again
+	c, _ = testingConfig()
+	c.ZMQPort = "7470"
+	c.ZMQAckPort = "7471"
+	startTestingServer(t, c)
+}
@@ -1,6 +1,12 @@
 package tree
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
 
 // For testing functions
 import (
@@ -9,17 +15,67 @@ import (
 	"time"
 )
 
+// A value that replaces, rather than adds to, the value in its time bucket.
+// Queries return the value of the most recent bucket.
+type Gauge float64
+
+// Added instead of a Gauge to change the value of the most recent bucket of
+// the gauge by the delta, or 0 when there is none. It is stored as a Gauge.
+type GaugeDelta float64
+
+// Returned by AddData when a value does not match the type already
+// stored under the key (e.g. an INCR on a key that was created by APPEND)
+var ErrTypeConflict = errors.New("value type conflicts with existing data for key")
+
+// The methods of Tree are safe for concurrent use. Code that walks the
+// nodes directly must hold the read lock while doing so.
 type Tree struct {
+	sync.RWMutex
 	DataNode      *Node
 	TimestampNode *Node
 }
 
-func (t *Tree) AddData(key string, value interface{}, timestamp string) {
-	bottom := t.DataNode.AddChild(strings.Split(key, "."))
+// Adds value under key for the timestamp given as Unix seconds, with an
+// optional fractional part (see ParseTimestamp)
+func (t *Tree) AddData(key string, value interface{}, timestamp string) error {
+	ts, err := ParseTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	return t.AddDataAt(key, value, ts)
+}
+
+// Adds value under key for the timestamp ts given in Unix nanoseconds. The
+// timestamp nodes are keyed by FormatTimestamp, so that every spelling of
+// a timestamp ends up in the same node.
+func (t *Tree) AddDataAt(key string, value interface{}, ts int64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	timestamp := FormatTimestamp(ts)
+	path := strings.Split(key, ".")
+	existing := t.DataNode.find(path)
+	if d, ok := value.(GaugeDelta); ok {
+		value = Gauge(float64(d) + existing.lastGauge())
+	}
+	if existing != nil {
+		for _, c := range existing.Children {
+			if c.HasValue() && !sameValueType(c.Value, value) {
+				return ErrTypeConflict
+			}
+		}
+	}
+	bottom := t.DataNode.AddChild(path)
 	t.TimestampNode.AddValueToChild(timestamp, key, bottom, value)
+	t.TimestampNode.Children[timestamp].Timestamp = ts
+	bottom.Children[timestamp].Timestamp = ts
+	return nil
 }
 
 func (t *Tree) GetValue(key []string, tsList []string, intervalSeconds float64) interface{} {
+	t.RLock()
+	defer t.RUnlock()
+
 	return t.DataNode.GetValue(key, tsList, intervalSeconds)
 }
 
@@ -28,6 +84,13 @@ func (t *Tree) Timestamps() *map[string]*Node {
 }
 
 func (t *Tree) DoGC(ts string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.doGC(ts)
+}
+
+func (t *Tree) doGC(ts string) {
 	if !t.TimestampNode.hasChild(ts) {
 		return
 	}
@@ -68,16 +131,40 @@ func (t *Tree) DoGC(ts string) {
 	t.TimestampNode.DeleteChild(ts)
 }
 
+// Runs a GC on every timestamp older than cutoff (in Unix nanoseconds)
+// and returns the number of leafs that were deleted
+func (t *Tree) GCBefore(cutoff int64) int {
+	t.Lock()
+	defer t.Unlock()
+
+	var expired []*Node
+	for _, c := range t.TimestampNode.Children {
+		if c.Timestamp < cutoff {
+			expired = append(expired, c)
+		}
+	}
+
+	freed := 0
+	for _, c := range expired {
+		freed += len(c.Children)
+		t.doGC(c.Key)
+	}
+	return freed
+}
+
 func (t *Tree) CheckGCRunning() bool {
-	// Check if there is anything in the pfdTree older than 70 seconds.
+	// Check if there is anything in the pfdTree older than 65 seconds.
+	return t.CheckGCRunningFor(65 * time.Second)
+}
 
-	roundToNearest := 5
+func (t *Tree) CheckGCRunningFor(maxAge time.Duration) bool {
+	// Check if there is anything in the pfdTree older than maxAge.
+	t.RLock()
+	defer t.RUnlock()
 
-	currentTime := time.Now().Unix()
-	gcTime := roundToNearest*int(currentTime/int64(roundToNearest)) - 65
-	gcTimeStr := strconv.Itoa(gcTime)
+	cutoff := time.Now().Add(-maxAge).UnixNano()
 	for _, c := range *t.Timestamps() {
-		if c.Key < gcTimeStr {
+		if c.Timestamp < cutoff {
 			return false
 		}
 	}
@@ -85,6 +172,8 @@ func (t *Tree) CheckGCRunning() bool {
 }
 
 func (t *Tree) GetOldestTS() int {
+	t.RLock()
+	defer t.RUnlock()
 
 	//Get all the timestamp nodes map[timestamp]*node
 	timestamps := t.Timestamps()
@@ -92,22 +181,22 @@ func (t *Tree) GetOldestTS() int {
 	if len(*timestamps) == 0 {
 		return 0
 	}
-	oldestTs := math.MaxInt32
-	for k, _ := range *timestamps {
-		key, _ := strconv.Atoi(k)
-		if key < oldestTs {
-			oldestTs = key
+	var oldestTs int64 = math.MaxInt64
+	for _, c := range *timestamps {
+		if c.Timestamp < oldestTs {
+			oldestTs = c.Timestamp
 		}
 
 	}
-	return oldestTs
+	return int(oldestTs / int64(time.Second))
 }
 
 type Node struct {
-	Key      string
-	Children map[string]*Node
-	Parent   *Node
-	Value    interface{}
+	Key       string
+	Children  map[string]*Node
+	Parent    *Node
+	Value     interface{}
+	Timestamp int64 // Unix nanoseconds, for timestamp nodes
 }
 
 func (n *Node) hasChild(key string) bool {
@@ -149,6 +238,16 @@ func (n *Node) AddChild(key []string) *Node {
 	return n.Children[key[0]].AddChild(key[1:])
 }
 
+// Returns the node at the end of key without creating it, or nil
+func (n *Node) find(key []string) *Node {
+	for _, k := range key {
+		if n = n.GetChild(k); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
 func (n *Node) AddValueToChild(ts string, key string, leaf *Node, value interface{}) {
 	tsLeaf := n.AddChild([]string{ts, key})
 
@@ -201,8 +300,101 @@ func (n *Node) GetValue(key []string, tsList []string, intervalSeconds float64)
 	}
 }
 
+// Returns the value of the most recent bucket of a gauge, 0 when there is
+// none
+func (n *Node) lastGauge() float64 {
+	if n == nil {
+		return 0
+	}
+	var last Gauge
+	var latest int64
+	found := false
+	for _, c := range n.Children {
+		if g, ok := c.Value.(Gauge); ok && (!found || c.Timestamp > latest) {
+			last, latest, found = g, c.Timestamp, true
+		}
+	}
+	return float64(last)
+}
+
+// A value of a key, either the value of one bucket or the value of all its
+// buckets as GetValue computes it
+type Row struct {
+	Key       string      // Dotted key
+	Timestamp string      // Bucket of the value, empty for the value of all buckets
+	Value     interface{} // int, float64 or []interface{}
+
+	ts int64
+}
+
+// Returns the rows of the keys matched by key, which may contain *
+// segments, sorted by key and timestamp. With perBucket a key has a row for
+// each of its buckets, otherwise a single row.
+func (t *Tree) GetRows(key []string, tsList []string, intervalSeconds float64, perBucket bool) []Row {
+	t.RLock()
+	defer t.RUnlock()
+
+	var rows []Row
+	t.DataNode.collectRows(nil, key, tsList, intervalSeconds, perBucket, &rows)
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Key != rows[j].Key {
+			return rows[i].Key < rows[j].Key
+		}
+		return rows[i].ts < rows[j].ts
+	})
+	return rows
+}
+
+// Walks the nodes matched by key as GetValue does, adding their rows
+func (n *Node) collectRows(path []string, key []string, tsList []string, intervalSeconds float64, perBucket bool, rows *[]Row) {
+	if n == nil {
+		return
+	}
+
+	hasValue := false
+	for _, c := range n.Children {
+		if c != nil && c.HasValue() {
+			hasValue = true
+			break
+		}
+	}
+	if len(key) == 0 || key[0] == "*" && hasValue {
+		if !hasValue {
+			return
+		}
+		name := strings.Join(path, ".")
+		if !perBucket {
+			if v := generateValue(n, tsList, intervalSeconds); v != nil {
+				*rows = append(*rows, Row{Key: name, Value: v})
+			}
+			return
+		}
+		for _, c := range n.Children {
+			if c == nil || !c.HasValue() || len(tsList) > 0 && !isInArray(c.Key, &tsList) {
+				continue
+			}
+			value := c.Value
+			if g, ok := value.(Gauge); ok {
+				value = float64(g)
+			}
+			*rows = append(*rows, Row{Key: name, Timestamp: c.Key, Value: value, ts: c.Timestamp})
+		}
+		return
+	}
+
+	if key[0] == "*" {
+		for _, c := range n.Children {
+			c.collectRows(append(path[:len(path):len(path)], c.Key), key[1:], tsList, intervalSeconds, perBucket, rows)
+		}
+		return
+	}
+	n.GetChild(key[0]).collectRows(append(path[:len(path):len(path)], key[0]), key[1:], tsList, intervalSeconds, perBucket, rows)
+}
+
 func (n *Node) setValue(value interface{}) {
-	if x, ok := value.(int); ok {
+	if g, ok := value.(Gauge); ok {
+		n.Value = g
+	} else if x, ok := value.(int); ok {
 		if n.Value == nil {
 			n.Value = 0
 		}
@@ -218,6 +410,21 @@ func (n *Node) setValue(value interface{}) {
 	}
 }
 
+func sameValueType(a, b interface{}) bool {
+	switch a.(type) {
+	case int:
+		_, ok := b.(int)
+		return ok
+	case []interface{}:
+		_, ok := b.([]interface{})
+		return ok
+	case Gauge:
+		_, ok := b.(Gauge)
+		return ok
+	}
+	return false
+}
+
 func (n *Node) GetNumChildren() int {
 	//Return the number of children of the node.
 	nodeArr := n.GetAllChildren()
@@ -226,6 +433,9 @@ func (n *Node) GetNumChildren() int {
 
 func (t *Tree) GetNumLeafs() int {
 	//Return the number of leafs in the tree.
+	t.RLock()
+	defer t.RUnlock()
+
 	if t.TimestampNode == nil {
 		return 0
 	}
@@ -238,6 +448,22 @@ func (t *Tree) GetNumLeafs() int {
 	return NumLeafs
 }
 
+func (t *Tree) GetNumNodes() int {
+	//Return the number of nodes under the data root, leafs included.
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.DataNode.countDescendants()
+}
+
+func (n *Node) countDescendants() int {
+	count := len(n.Children)
+	for _, c := range n.Children {
+		count += c.countDescendants()
+	}
+	return count
+}
+
 func generateValue(n *Node, tsList []string, intervalSeconds float64) interface{} {
 	if n == nil {
 		return nil
@@ -246,10 +472,17 @@ func generateValue(n *Node, tsList []string, intervalSeconds float64) interface{
 	var returnVal interface{}
 	var numDataPoints float64 = 1
 	var isInt bool = false
+	var latest int64
 
 	for _, c := range n.Children {
 		if c != nil && c.HasValue() && (tsList == nil || len(tsList) == 0 || isInArray(c.Key, &tsList)) {
-			if returnVal == nil {
+			if g, ok := c.Value.(Gauge); ok {
+				// Gauges take the value of the most recent bucket
+				if returnVal == nil || c.Timestamp > latest {
+					returnVal = float64(g)
+					latest = c.Timestamp
+				}
+			} else if returnVal == nil {
 				returnVal = c.Value
 			} else if x, ok := c.Value.(int); ok {
 				isInt = true
@@ -289,3 +522,55 @@ func isInArray(item string, l *[]string) bool {
 	}
 	return false
 }
+
+// Parses a timestamp key given as Unix seconds with an optional fractional
+// part (e.g. "1404148628" or "1404148628.25") into Unix nanoseconds
+func ParseTimestamp(s string) (int64, error) {
+	secs, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		secs, frac = s[:i], s[i+1:]
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	var nsec int64
+	if frac != "" {
+		if strings.Trim(frac, "0123456789") != "" {
+			return 0, errors.New("invalid fractional seconds in timestamp " + s)
+		}
+		nsec, _ = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	}
+	if strings.HasPrefix(secs, "-") {
+		nsec = -nsec
+	}
+	if sec > math.MaxInt64/int64(time.Second) || sec < math.MinInt64/int64(time.Second) {
+		return 0, errors.New("timestamp out of range " + s)
+	}
+	ts := sec*int64(time.Second) + nsec
+	if nsec > 0 && ts < 0 || nsec < 0 && ts > 0 {
+		return 0, errors.New("timestamp out of range " + s)
+	}
+	return ts, nil
+}
+
+// Formats a timestamp in Unix nanoseconds as the key used in the tree: whole
+// seconds, followed by the fractional part for sub-second timestamps
+func FormatTimestamp(ts int64) string {
+	sec, nsec := ts/int64(time.Second), ts%int64(time.Second)
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if nsec < 0 {
+		nsec = -nsec
+		if sec == 0 {
+			sign = "-"
+		}
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%09d", nsec), "0")
+	return sign + strconv.FormatInt(sec, 10) + "." + frac
+}